@@ -0,0 +1,48 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+
+	"import.name/pan"
+)
+
+// marshalBytes encodes a byte slice or array as a base64 string.
+func marshalBytes(v reflect.Value) string {
+	var b []byte
+
+	if v.Kind() == reflect.Slice {
+		b = v.Bytes()
+	} else {
+		b = make([]byte, v.Len())
+		for i := range b {
+			b[i] = byte(v.Index(i).Uint())
+		}
+	}
+
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// unmarshalBytes decodes a base64 string into a byte slice or array.
+func unmarshalBytes(s string, dest reflect.Value) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		pan.Panic(fmt.Errorf("unmarshal: %s: %w", dest.Type(), err))
+	}
+
+	if dest.Kind() == reflect.Slice {
+		dest.SetBytes(b)
+		return
+	}
+
+	if len(b) != dest.Len() {
+		pan.Panic(fmt.Errorf("unmarshal: %s: decoded length is %d", dest.Type(), len(b)))
+	}
+	for i, x := range b {
+		dest.Index(i).SetUint(uint64(x))
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"reflect"
+	"testing"
+)
+
+type (
+	blob   []byte
+	octet  uint8
+	octets []octet
+)
+
+func TestBytes(t *testing.T) {
+	type record struct {
+		Data   []byte
+		Blob   blob
+		Octets octets
+		Hash   [4]byte
+		Empty  []byte
+		Nil    []byte
+	}
+
+	x := &record{
+		Data:   []byte("hello"),
+		Blob:   blob{1, 2, 3},
+		Octets: octets{255},
+		Hash:   [4]byte{0xde, 0xad, 0xbe, 0xef},
+		Empty:  []byte{},
+	}
+
+	objects, err := Marshal(x, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	expect := map[string]any{
+		"Data":   "aGVsbG8=",
+		"Blob":   "AQID",
+		"Octets": "/w==",
+		"Hash":   "3q2+7w==",
+		"Empty":  "",
+	}
+	if !reflect.DeepEqual(objects[0], expect) {
+		t.Errorf("marshaled: %#v", objects[0])
+	}
+
+	y := new(record)
+	if err := Unmarshal(objects, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+
+	// Element lists are still accepted.
+	sources := []any{map[string]any{"Data": []any{104, 105}}}
+
+	z := new(record)
+	if err := Unmarshal(sources, z, NewTypes()); err != nil {
+		t.Fatal(err)
+	}
+	if string(z.Data) != "hi" {
+		t.Errorf("data: %q", z.Data)
+	}
+
+	for _, src := range []map[string]any{
+		{"Data": "not base64!"},
+		{"Hash": "AQID"},
+	} {
+		if err := Unmarshal([]any{src}, new(record), NewTypes()); err == nil {
+			t.Errorf("%v: no error", src)
+		}
+	}
+}
+
+func BenchmarkMarshalBytes(b *testing.B) {
+	x := &struct{ Data []byte }{make([]byte, 1<<20)}
+
+	for range b.N {
+		if _, err := Marshal(x, NewTypes(), false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkMarshalInt8s measures the per-element path for comparison with
+// BenchmarkMarshalBytes.
+func BenchmarkMarshalInt8s(b *testing.B) {
+	x := &struct{ Data []int8 }{make([]int8, 1<<20)}
+
+	for range b.N {
+		if _, err := Marshal(x, NewTypes(), false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"fmt"
+	"reflect"
+)
+
+type codec struct {
+	name   string
+	t      reflect.Type // May be an interface type.
+	repr   reflect.Type
+	encode func(reflect.Value) (reflect.Value, error)
+	decode func(reflect.Value) (reflect.Value, error)
+}
+
+// RegisterCodec registers a name for interface values of type T, which are
+// converted to a representation of type R when marshaling and back when
+// unmarshaling.  R is marshaled normally.
+//
+// T may be an interface type, in which case the codec applies to all dynamic
+// types implementing it (unless they are registered separately).  This makes
+// it possible to capture the relevant data of values whose concrete types are
+// not accessible, such as fs.FileInfo: encode copies the data into a plain
+// struct, and decode returns a stand-in implementation of the interface.
+func RegisterCodec[T, R any](ts *Types, name string, encode func(T) (R, error), decode func(R) (T, error)) error {
+	t := reflect.TypeFor[T]()
+	repr := reflect.TypeFor[R]()
+
+	if err := checkTypeName(name, t); err != nil {
+		return err
+	}
+	if !isTypeSupported(repr) {
+		return fmt.Errorf("marshal: %w", &UnsupportedTypeError{repr})
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if _, found := ts.typeNames[t]; found || ts.findCodec(t) != nil {
+		return fmt.Errorf("marshal: type already registered: %s", t)
+	}
+	if ts.nameTaken(name) {
+		return fmt.Errorf("marshal: type name already registered: %q", name)
+	}
+
+	ts.codecs = append(ts.codecs, &codec{
+		name: name,
+		t:    t,
+		repr: repr,
+		encode: func(v reflect.Value) (reflect.Value, error) {
+			r, err := encode(v.Interface().(T))
+			return reflect.ValueOf(&r).Elem(), err
+		},
+		decode: func(v reflect.Value) (reflect.Value, error) {
+			x, err := decode(v.Interface().(R))
+			return reflect.ValueOf(&x).Elem(), err
+		},
+	})
+	return nil
+}
+
+// codecFor finds a codec for a type.  An exact match is preferred over an
+// interface type implemented by t.
+func (ts *Types) codecFor(t reflect.Type) *codec {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return ts.findCodec(t)
+}
+
+func (ts *Types) codecByName(name string) *codec {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return ts.findCodecByName(name)
+}
+
+// findCodec is like codecFor, but the lock must be held.
+func (ts *Types) findCodec(t reflect.Type) *codec {
+	for _, c := range ts.codecs {
+		if c.t == t {
+			return c
+		}
+	}
+
+	for _, c := range ts.codecs {
+		if c.t.Kind() == reflect.Interface && t.Implements(c.t) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+func (ts *Types) findCodecByName(name string) *codec {
+	for _, c := range ts.codecs {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fileInfoSnapshot struct {
+	Name    string
+	Size    int64
+	Mode    fs.FileMode
+	ModTime int64
+}
+
+type fileInfo struct {
+	snapshot fileInfoSnapshot
+}
+
+func (fi fileInfo) Name() string       { return fi.snapshot.Name }
+func (fi fileInfo) Size() int64        { return fi.snapshot.Size }
+func (fi fileInfo) Mode() fs.FileMode  { return fi.snapshot.Mode }
+func (fi fileInfo) ModTime() time.Time { return time.Unix(0, fi.snapshot.ModTime) }
+func (fi fileInfo) IsDir() bool        { return fi.snapshot.Mode.IsDir() }
+func (fi fileInfo) Sys() any           { return nil }
+
+func TestCodecInterface(t *testing.T) {
+	types := NewTypes()
+
+	if err := RegisterCodec(types, "fileinfo",
+		func(fi fs.FileInfo) (fileInfoSnapshot, error) {
+			return fileInfoSnapshot{fi.Name(), fi.Size(), fi.Mode(), fi.ModTime().UnixNano()}, nil
+		},
+		func(s fileInfoSnapshot) (fs.FileInfo, error) {
+			return fileInfo{s}, nil
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RegisterCodec(types, "fileinfo",
+		func(x int) (int, error) { return x, nil },
+		func(x int) (int, error) { return x, nil },
+	); err == nil {
+		t.Error("duplicate codec name was registered")
+	}
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(filename, []byte("hello"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	type listing struct {
+		File fs.FileInfo
+		Dir  fs.FileInfo
+		Any  any
+	}
+
+	x := new(listing)
+	var err error
+	if x.File, err = os.Stat(filename); err != nil {
+		t.Fatal(err)
+	}
+	if x.Dir, err = os.Stat(dir); err != nil {
+		t.Fatal(err)
+	}
+	x.Any = x.File
+
+	objects, err := Marshal(x, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if _, found := objects[0].(map[string]any)["File"].(map[string]any)["fileinfo"]; !found {
+		t.Errorf("marshaled: %#v", objects[0])
+	}
+
+	y := new(listing)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	for _, pair := range [][2]fs.FileInfo{
+		{x.File, y.File},
+		{x.Dir, y.Dir},
+		{x.File, y.Any.(fs.FileInfo)},
+	} {
+		a, b := pair[0], pair[1]
+		if a.Name() != b.Name() || a.Size() != b.Size() || a.Mode() != b.Mode() || a.IsDir() != b.IsDir() || !a.ModTime().Equal(b.ModTime()) {
+			t.Errorf("mismatch:\na: %v %v %v %v\nb: %v %v %v %v", a.Name(), a.Size(), a.Mode(), a.ModTime(), b.Name(), b.Size(), b.Mode(), b.ModTime())
+		}
+	}
+	if !y.Dir.IsDir() {
+		t.Error("directory")
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrBudgetExceeded is reported by Encoder when the encoding of a value would
+// exceed Options.MaxOutputBytes.
+var ErrBudgetExceeded = errors.New("marshal: output byte budget exceeded")
+
+// UnregisteredTypeError is reported when marshaling a value of a type which is
+// not registered, or when a type name is not registered.  Use errors.As to
+// find it in the error chain.
+type UnregisteredTypeError struct {
+	Name string       // Set if the type name is unknown.
+	Type reflect.Type // Set if the name of a type is unknown.
+}
+
+func (e *UnregisteredTypeError) Error() string {
+	if e.Type != nil {
+		return fmt.Sprintf("type not registered: %s", e.Type)
+	}
+	return fmt.Sprintf("type name not registered: %q", e.Name)
+}
+
+// UnsupportedTypeError is reported when a type cannot be marshaled or
+// unmarshaled.  Use errors.As to find it in the error chain.
+type UnsupportedTypeError struct {
+	Type reflect.Type // Nil if unknown.
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	if e.Type == nil {
+		return "type not supported"
+	}
+	return fmt.Sprintf("type not supported: %s", e.Type)
+}
+
+// IndexError is reported when an object index is out of range of the object
+// list.  Use errors.As to find it in the error chain.
+type IndexError struct {
+	Index int
+	Len   int
+}
+
+func (e *IndexError) Error() string {
+	return fmt.Sprintf("object index %d out of range (have %d objects)", e.Index, e.Len)
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestErrorTypes(t *testing.T) {
+	type holder struct {
+		Alt  alt
+		Func func()
+		Next *holder
+	}
+
+	var unregistered *UnregisteredTypeError
+	_, err := Marshal(&holder{Alt: alt1{}}, NewTypes(), true)
+	if !errors.As(err, &unregistered) || unregistered.Type != reflect.TypeFor[alt1]() {
+		t.Error("marshal unregistered:", err)
+	}
+
+	err = Unmarshal([]any{map[string]any{"Alt": map[string]any{"alt9": nil}}}, new(holder), NewTypes())
+	if !errors.As(err, &unregistered) || unregistered.Name != "alt9" {
+		t.Error("unmarshal unregistered:", err)
+	}
+
+	var unsupported *UnsupportedTypeError
+	_, err = Marshal(&holder{Func: func() {}}, NewTypes(), false)
+	if !errors.As(err, &unsupported) || unsupported.Type != reflect.TypeFor[func()]() {
+		t.Error("unsupported:", err)
+	}
+
+	var index *IndexError
+	err = Unmarshal([]any{map[string]any{"Next": 3}}, new(holder), NewTypes())
+	if !errors.As(err, &index) || *index != (IndexError{3, 1}) {
+		t.Error("index:", err)
+	}
+	if err.Error() != "unmarshal: at .Next: object index 3 out of range (have 1 objects)" {
+		t.Error("message:", err)
+	}
+}
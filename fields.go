@@ -0,0 +1,321 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const defaultTagKey = "marshal"
+
+// syncTypes are skipped: they are left as zero values when unmarshaling.
+var syncTypes = map[reflect.Type]bool{
+	reflect.TypeFor[sync.Mutex]():     true,
+	reflect.TypeFor[sync.RWMutex]():   true,
+	reflect.TypeFor[sync.Once]():      true,
+	reflect.TypeFor[sync.WaitGroup](): true,
+}
+
+type field struct {
+	reflect.StructField
+	name      string // Map key.
+	tag       string // Struct tag value.
+	required  bool
+	omitEmpty bool
+	transform bool
+
+	// Function fields with a via option are not marshaled.  They are
+	// reconstructed from the named config field using a registered factory.
+	via      string
+	viaIndex []int
+
+	// Union variant fields are included only when the discriminator field's
+	// value is equal to the variant number.  Variants are numbered in
+	// declaration order, starting from zero.
+	union         string
+	discriminator []int
+	variant       int64
+}
+
+// structFields describes the visible fields of a struct type.
+//
+// The struct tag is of the form `marshal:"name,option,..."`, where the key is
+// the value of Options.TagKey (default "marshal").  A non-empty name replaces
+// the field name as the map key.  The name "-" (without options) omits the
+// field, including its promoted fields if it's embedded.  Supported options:
+//
+//   - encrypt: the marshaled value is passed through Options.Transform, and
+//     the source value through Options.Untransform.  The field type must not
+//     contain pointers or interfaces, and its values are not interned.
+//   - omitempty: the field is not marshaled if it's false, zero, nil, or an
+//     empty string, array, slice or map.
+//   - required: unmarshaling fails if the field is missing from the source.
+//   - via=Field: the function-typed field is not marshaled; when unmarshaling,
+//     it is created by calling a factory registered using
+//     Types.RegisterFuncFactory with the value of the named field.
+//   - union=Field: the field is a variant of a tagged union.  Field names an
+//     integer discriminator field of the same struct.  Only the variant
+//     selected by the discriminator is marshaled and unmarshaled.
+//
+// Fields of types sync.Mutex, sync.RWMutex, sync.Once and sync.WaitGroup are
+// omitted.  A sync.Map is marshaled as a map of its entries, so it must not be
+// modified concurrently; its keys must be of the same supported type.
+//
+// When fields have the same name, the rules of encoding/json apply: the field
+// with the shallowest embedding depth is used, and at the same depth a field
+// named by a tag takes precedence.  Fields which remain ambiguous are omitted.
+//
+// The result is cached, so it must not be modified.
+func structFields(t reflect.Type, tagKey string) ([]field, error) {
+	key := fieldCacheKey{t, tagKey}
+	if x, found := fieldCache.Load(key); found {
+		e := x.(fieldCacheEntry)
+		return e.fields, e.err
+	}
+
+	fields, err := parseStructFields(t, tagKey)
+	fieldCache.Store(key, fieldCacheEntry{fields, err})
+	return fields, err
+}
+
+// fieldCache maps fieldCacheKey to fieldCacheEntry.
+var fieldCache sync.Map
+
+type fieldCacheKey struct {
+	t      reflect.Type
+	tagKey string
+}
+
+type fieldCacheEntry struct {
+	fields []field
+	err    error
+}
+
+func parseStructFields(t reflect.Type, tagKey string) ([]field, error) {
+	type candidate struct {
+		reflect.StructField
+		tag   string
+		name  string
+		named bool // Name from tag.
+		opts  []string
+	}
+
+	visible := reflect.VisibleFields(t)
+	candidates := make([]candidate, 0, len(visible))
+	byName := make(map[string][]int) // Candidate indexes.
+	var skipped [][]int
+
+	for _, f := range visible {
+		tag := f.Tag.Get(tagKey)
+
+		if syncTypes[f.Type] || tag == "-" {
+			skipped = append(skipped, f.Index)
+			continue
+		}
+		if slices.ContainsFunc(skipped, func(prefix []int) bool {
+			return len(prefix) < len(f.Index) && slices.Equal(prefix, f.Index[:len(prefix)])
+		}) {
+			continue // Promoted from a skipped field.
+		}
+
+		c := candidate{StructField: f, tag: tag}
+		c.name, c.opts = parseTag(tag)
+		c.named = c.name != ""
+		if !c.named {
+			c.name = f.Name
+		}
+
+		byName[c.name] = append(byName[c.name], len(candidates))
+		candidates = append(candidates, c)
+	}
+
+	// The dominant field of each name is the only one at the shallowest
+	// depth, or the only tagged one at that depth.  Others are dropped.
+	dominant := make(map[string]int, len(byName))
+	for name, indexes := range byName {
+		depth := len(candidates[indexes[0]].Index)
+		for _, i := range indexes {
+			depth = min(depth, len(candidates[i].Index))
+		}
+
+		var shallow, named []int
+		for _, i := range indexes {
+			if len(candidates[i].Index) == depth {
+				shallow = append(shallow, i)
+				if candidates[i].named {
+					named = append(named, i)
+				}
+			}
+		}
+
+		switch {
+		case len(shallow) == 1:
+			dominant[name] = shallow[0]
+		case len(named) == 1:
+			dominant[name] = named[0]
+		}
+	}
+
+	fields := make([]field, 0, len(dominant))
+	variants := make(map[string]int64)
+
+	for i, c := range candidates {
+		if j, found := dominant[c.name]; !found || j != i {
+			continue // Shadowed or ambiguous.
+		}
+
+		f, tag, name, opts := c.StructField, c.tag, c.name, c.opts
+
+		info := field{
+			StructField: f,
+			name:        name,
+			tag:         tag,
+		}
+
+		for _, opt := range opts {
+			switch opt {
+			case "encrypt":
+				if mayContainPointers(f.Type, make(map[reflect.Type]bool)) {
+					return nil, fmt.Errorf("marshal: %s.%s: encrypt option on field which may contain pointers", t, f.Name)
+				}
+				info.transform = true
+			case "omitempty":
+				info.omitEmpty = true
+			case "required":
+				info.required = true
+			}
+
+			if via, found := strings.CutPrefix(opt, "via="); found {
+				if f.Type.Kind() != reflect.Func {
+					return nil, fmt.Errorf("marshal: %s.%s: via option on non-function field", t, f.Name)
+				}
+
+				c, found := t.FieldByName(via)
+				if !found {
+					return nil, fmt.Errorf("marshal: %s.%s: config field not found: %s", t, f.Name, via)
+				}
+
+				info.via = via
+				info.viaIndex = c.Index
+			}
+
+			if union, found := strings.CutPrefix(opt, "union="); found {
+				d, found := t.FieldByName(union)
+				if !found {
+					return nil, fmt.Errorf("marshal: %s.%s: union discriminator field not found: %s", t, f.Name, union)
+				}
+
+				switch d.Type.Kind() {
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+				default:
+					return nil, fmt.Errorf("marshal: %s.%s: union discriminator is not an integer: %s", t, f.Name, union)
+				}
+
+				info.union = union
+				info.discriminator = d.Index
+				info.variant = variants[union]
+				variants[union]++
+			}
+		}
+
+		fields = append(fields, info)
+	}
+
+	return fields, nil
+}
+
+// mayContainPointers checks if values of type t may contain pointers or
+// interfaces.  They are marshaled as object indexes, so the referenced values
+// would be stored outside of the field.
+func mayContainPointers(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+
+	switch t.Kind() {
+	case reflect.Array, reflect.Chan, reflect.Slice:
+		return mayContainPointers(t.Elem(), seen)
+
+	case reflect.Map:
+		return mayContainPointers(t.Key(), seen) || mayContainPointers(t.Elem(), seen)
+
+	case reflect.Struct:
+		for i := range t.NumField() {
+			if mayContainPointers(t.Field(i).Type, seen) {
+				return true
+			}
+		}
+		return false
+
+	case reflect.Interface, reflect.Pointer, reflect.UnsafePointer:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// isEmpty checks if the value of a field with the omitempty option should be
+// omitted.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Struct:
+		return false
+	default:
+		return v.IsZero()
+	}
+}
+
+// selected checks if a field is not an inactive union variant in struct v.  A
+// discriminator behind a nil embedded pointer is treated as zero.
+func (f *field) selected(v reflect.Value) bool {
+	if f.union == "" {
+		return true
+	}
+
+	d, err := v.FieldByIndexErr(f.discriminator)
+	if err != nil {
+		return f.variant == 0
+	}
+
+	switch d.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return d.Int() == f.variant
+	default:
+		return f.variant >= 0 && d.Uint() == uint64(f.variant)
+	}
+}
+
+// fieldByIndexAlloc is like reflect.Value.FieldByIndex, but it allocates nil
+// embedded struct pointers.
+func fieldByIndexAlloc(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("cannot set embedded pointer to unexported struct: %s", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+func parseTag(tag string) (name string, opts []string) {
+	name, rest, found := strings.Cut(tag, ",")
+	if found {
+		opts = strings.Split(rest, ",")
+	}
+	return
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"fmt"
+	"reflect"
+
+	"import.name/pan"
+)
+
+// Marshaler is implemented by types which provide their own representation.
+// The returned value is marshaled in place of the original value, as if it
+// were stored in an empty interface: registered types are wrapped with their
+// names, and pointers are shared as usual.
+type Marshaler interface {
+	MarshalGraph() (any, error)
+}
+
+// Unmarshaler is implemented by types which decode their own representation.
+// The source is decoded into an empty interface value before it is passed to
+// UnmarshalGraph, so a top-level type-name wrapper yields a value of the
+// registered type; nested values are passed in generic form.
+type Unmarshaler interface {
+	UnmarshalGraph(any) error
+}
+
+var (
+	marshalerType   = reflect.TypeFor[Marshaler]()
+	unmarshalerType = reflect.TypeFor[Unmarshaler]()
+)
+
+// marshalGraph returns the custom representation of v if it implements
+// Marshaler.  The representation is an interface value.
+func marshalGraph(v reflect.Value) (reflect.Value, bool) {
+	x, ok := hook(v, marshalerType).(Marshaler)
+	if !ok {
+		return reflect.Value{}, false
+	}
+
+	r, err := x.MarshalGraph()
+	if err != nil {
+		pan.Panic(fmt.Errorf("marshal: %s: %w", v.Type(), err))
+	}
+	return reflect.ValueOf(&r).Elem(), true
+}
+
+// unmarshalGraph returns the Unmarshaler implementation of dest, if any.
+func unmarshalGraph(dest reflect.Value) (Unmarshaler, bool) {
+	switch dest.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		return nil, false
+	}
+
+	x, ok := hook(dest, unmarshalerType).(Unmarshaler)
+	return x, ok
+}
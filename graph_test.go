@@ -0,0 +1,115 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type version struct {
+	major, minor int
+}
+
+func (v version) MarshalGraph() (any, error) {
+	return fmt.Sprintf("%d.%d", v.major, v.minor), nil
+}
+
+func (v *version) UnmarshalGraph(x any) error {
+	s, ok := x.(string)
+	if !ok {
+		return errors.New("version is not a string")
+	}
+	_, err := fmt.Sscanf(s, "%d.%d", &v.major, &v.minor)
+	return err
+}
+
+type settings struct {
+	values map[string]int
+}
+
+func (s *settings) MarshalGraph() (any, error) {
+	m := make(map[string]any, len(s.values))
+	for k, v := range s.values {
+		m[k] = v
+	}
+	return m, nil
+}
+
+func (s *settings) UnmarshalGraph(x any) error {
+	m, ok := x.(map[string]any)
+	if !ok {
+		return errors.New("settings is not a map")
+	}
+	s.values = make(map[string]int, len(m))
+	for k, v := range m {
+		s.values[k] = v.(int)
+	}
+	return nil
+}
+
+// anchor is represented by the event it refers to.
+type anchor struct {
+	event *event
+}
+
+func (a anchor) MarshalGraph() (any, error) {
+	return a.event, nil
+}
+
+func (a *anchor) UnmarshalGraph(x any) error {
+	a.event, _ = x.(*event)
+	return nil
+}
+
+func TestGraphMarshaler(t *testing.T) {
+	type document struct {
+		Version  version
+		Settings settings
+		Anchor   anchor
+		Head     *event
+	}
+
+	types := NewTypes().MustRegister(Type("event", &event{}))
+
+	head := &event{Seq: 1}
+	x := &document{version{1, 2}, settings{map[string]int{"a": 3}}, anchor{head}, head}
+
+	objects, err := Marshal(x, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	expect := []any{
+		map[string]any{
+			"Version":  "1.2",
+			"Settings": map[string]any{"a": 3},
+			"Anchor":   map[string]any{"event": 1},
+			"Head":     1,
+		},
+		map[string]any{"Seq": 1},
+	}
+	if !reflect.DeepEqual(objects, expect) {
+		t.Errorf("objects: %#v", objects)
+	}
+
+	y := new(document)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+	if y.Anchor.event != y.Head {
+		t.Error("sharing was not preserved")
+	}
+
+	objects[0].(map[string]any)["Version"] = 12
+
+	if err := Unmarshal(objects, new(document), types); err == nil {
+		t.Error("invalid representation was accepted")
+	}
+}
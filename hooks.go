@@ -0,0 +1,60 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"fmt"
+	"reflect"
+
+	"import.name/pan"
+)
+
+// BeforeMarshaler is implemented by types which need to prepare for being
+// marshaled.  BeforeMarshal is called before the value is traversed.
+type BeforeMarshaler interface {
+	BeforeMarshal() error
+}
+
+// AfterUnmarshaler is implemented by types which need to fix up their state
+// after being unmarshaled.  AfterUnmarshal is called after the value has been
+// decoded, but values referenced via pointers may still be incomplete if the
+// graph contains cycles.
+type AfterUnmarshaler interface {
+	AfterUnmarshal() error
+}
+
+var (
+	beforeMarshalerType  = reflect.TypeFor[BeforeMarshaler]()
+	afterUnmarshalerType = reflect.TypeFor[AfterUnmarshaler]()
+)
+
+func beforeMarshal(v reflect.Value) {
+	if x, ok := hook(v, beforeMarshalerType).(BeforeMarshaler); ok {
+		if err := x.BeforeMarshal(); err != nil {
+			pan.Panic(fmt.Errorf("marshal: %s: %w", v.Type(), err))
+		}
+	}
+}
+
+func afterUnmarshal(v reflect.Value) {
+	if x, ok := hook(v, afterUnmarshalerType).(AfterUnmarshaler); ok {
+		if err := x.AfterUnmarshal(); err != nil {
+			pan.Panic(fmt.Errorf("unmarshal: %s: %w", v.Type(), err))
+		}
+	}
+}
+
+// hook returns v or its address as an interface value if it implements the
+// hook interface type.
+func hook(v reflect.Value, iface reflect.Type) any {
+	if v.CanAddr() && reflect.PointerTo(v.Type()).Implements(iface) {
+		if p := v.Addr(); p.CanInterface() {
+			return p.Interface()
+		}
+	}
+	if v.Type().Implements(iface) && v.CanInterface() {
+		return v.Interface()
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+
+	"import.name/pan"
+)
+
+// MarshalJSON marshals x and encodes the object list as JSON.  Complex numbers
+// can be encoded only with Options.ComplexPairs.
+func MarshalJSON(x any, types *Types, opts Options) ([]byte, error) {
+	objects, err := MarshalOptions(x, types, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(objects)
+}
+
+// UnmarshalJSON decodes a JSON-encoded object list into the value pointed to
+// by ptr.  JSON numbers are converted to the numeric types of the
+// destination, and string map keys to integer keys.  Integers are decoded
+// without loss of precision.
+func UnmarshalJSON(data []byte, ptr any, types *Types) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	var sources []any
+	if err := d.Decode(&sources); err != nil {
+		return err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return errors.New("unmarshal: invalid data after JSON value")
+	}
+
+	if err := pan.Recover(func() {
+		for i, x := range sources {
+			sources[i] = convertJSONNumbers(x)
+		}
+	}); err != nil {
+		return err
+	}
+
+	return Unmarshal(sources, ptr, types)
+}
+
+// convertJSONNumbers replaces json.Number values within a decoded JSON value.
+func convertJSONNumbers(x any) any {
+	switch x := x.(type) {
+	case json.Number:
+		return parseJSONNumber(string(x)).Interface()
+
+	case []any:
+		for i, elem := range x {
+			x[i] = convertJSONNumbers(elem)
+		}
+
+	case map[string]any:
+		for key, value := range x {
+			x[key] = convertJSONNumbers(value)
+		}
+	}
+
+	return x
+}
+
+var jsonNumberType = reflect.TypeFor[json.Number]()
+
+// parseJSONNumber converts a json.Number source to float64, or to int64 or
+// uint64 if the integer cannot be represented exactly as float64.
+func parseJSONNumber(n string) reflect.Value {
+	if i, err := strconv.ParseInt(n, 10, 64); err == nil {
+		if i >= -(1<<53) && i <= 1<<53 {
+			return reflect.ValueOf(float64(i))
+		}
+		return reflect.ValueOf(i)
+	}
+	if u, err := strconv.ParseUint(n, 10, 64); err == nil {
+		return reflect.ValueOf(u)
+	}
+
+	f, err := strconv.ParseFloat(n, 64)
+	if err != nil {
+		pan.Panic(fmt.Errorf("unmarshal: invalid number: %q", n))
+	}
+	return reflect.ValueOf(f)
+}
+
+// Encoder writes JSON-encoded object lists to a stream.
+//
+// The object list of each value is built in memory before anything is written.
+// Objects are written in index order, and an object is completed only after
+// the objects it refers to: the root object has index 0 but it is completed
+// last, so no prefix of the list can be written earlier.  Memory use is
+// therefore the same as with MarshalOptions.  The JSON encoding is written one
+// object at a time, so the encoding of the whole list is never buffered.
+// Options.MaxOutputBytes bounds the output, not the memory used by marshaling.
+type Encoder struct {
+	w     io.Writer
+	types *Types
+	opts  Options
+}
+
+func NewEncoder(w io.Writer, types *Types, opts Options) *Encoder {
+	return &Encoder{w, types, opts}
+}
+
+// Encode writes the object list of x as a JSON array followed by a newline.
+func (e *Encoder) Encode(x any) error {
+	objects, err := MarshalOptions(x, e.types, e.opts)
+	if err != nil {
+		return err
+	}
+
+	w := e.w
+	if e.opts.MaxOutputBytes > 0 {
+		w = &budgetWriter{e.w, e.opts.MaxOutputBytes}
+	}
+
+	sep := []byte{'['}
+
+	for _, obj := range objects {
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(sep); err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+
+		sep[0] = ','
+	}
+
+	if len(objects) == 0 {
+		_, err = io.WriteString(w, "[]\n")
+	} else {
+		_, err = io.WriteString(w, "]\n")
+	}
+	return err
+}
+
+// budgetWriter fails writes which would exceed the remaining byte count.
+type budgetWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (b *budgetWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > b.n {
+		return 0, ErrBudgetExceeded
+	}
+	n, err := b.w.Write(p)
+	b.n -= int64(n)
+	return n, err
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	types := NewTypes().MustRegister(
+		TypeName(alt1{}),
+		Type("alt2ptr", &alt2{}),
+	)
+
+	x := newTopLevel(types)
+
+	data, err := MarshalJSON(x, types, Options{IgnoreUnsupportedTypes: true})
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	y := new(topLevel)
+	if err := UnmarshalJSON(data, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	x.UnsupportedMap = nil
+	x.UnsupportedFunc = nil
+	x.UnsupportedChan = nil
+	x.UnsupportedUnsafe = nil
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+	if y.Self != y || y.StructEmbedded.Parent != y {
+		t.Error("sharing was not preserved")
+	}
+
+	if err := UnmarshalJSON([]byte("{}"), y, types); err == nil {
+		t.Error("invalid JSON was accepted")
+	}
+}
+
+func TestJSONLargeIntegers(t *testing.T) {
+	type ids struct {
+		Signed   int64
+		Unsigned uint64
+		Small    int
+		Generic  any
+	}
+
+	x := &ids{math.MaxInt64 - 1, math.MaxUint64, 3, int64(1<<53 + 1)}
+
+	data, err := MarshalJSON(x, NewTypes(), Options{})
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	y := new(ids)
+	if err := UnmarshalJSON(data, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if *x != *y {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+
+	if err := UnmarshalJSON([]byte(`[{"Small":9007199254740993}]`), y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if y.Small != 9007199254740993 {
+		t.Errorf("small: %d", y.Small)
+	}
+
+	sources := []any{map[string]any{"Signed": json.Number("-9223372036854775807")}}
+	if err := Unmarshal(sources, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if y.Signed != math.MinInt64+1 {
+		t.Errorf("signed: %d", y.Signed)
+	}
+}
+
+func TestJSONComplex(t *testing.T) {
+	type signal struct {
+		Phase  complex128
+		Sample complex64
+		Table  []complex128
+	}
+
+	x := &signal{1.5 - 2i, 3 + 0.25i, []complex128{0, -1i}}
+
+	if _, err := MarshalJSON(x, NewTypes(), Options{}); err == nil {
+		t.Error("complex numbers were encoded as JSON without option")
+	}
+
+	data, err := MarshalJSON(x, NewTypes(), Options{ComplexPairs: true})
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if !bytes.Contains(data, []byte(`"Phase":[1.5,-2]`)) {
+		t.Errorf("encoding: %s", data)
+	}
+
+	y := new(signal)
+	if err := UnmarshalJSON(data, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	types := NewTypes().MustRegister(
+		TypeName(alt1{}),
+		Type("alt2ptr", &alt2{}),
+	)
+
+	opts := Options{IgnoreUnsupportedTypes: true, SortMapKeys: true}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, types, opts)
+
+	var expect []byte
+
+	for _, x := range []any{newTopLevel(types), &event{Seq: 1}} {
+		if err := e.Encode(x); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := MarshalJSON(x, types, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect = append(append(expect, data...), '\n')
+	}
+
+	if !bytes.Equal(buf.Bytes(), expect) {
+		t.Errorf("output:\n%s\nexpected:\n%s", buf.Bytes(), expect)
+	}
+}
+
+func TestEncoderBudget(t *testing.T) {
+	root := &refNode{Name: "root"}
+	for i := 0; i < 100; i++ {
+		root.Children = append(root.Children, &refNode{Name: "child"})
+	}
+
+	data, err := MarshalJSON(root, NewTypes(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(data)) + 1 // Newline.
+
+	for _, limit := range []int64{size, size + 1, 0} {
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf, NewTypes(), Options{MaxOutputBytes: limit}).Encode(root); err != nil {
+			t.Errorf("limit %d: %v", limit, err)
+		}
+		if int64(buf.Len()) != size {
+			t.Errorf("limit %d: wrote %d bytes", limit, buf.Len())
+		}
+	}
+
+	for _, limit := range []int64{size - 1, size / 2, 1} {
+		var buf bytes.Buffer
+		err := NewEncoder(&buf, NewTypes(), Options{MaxOutputBytes: limit}).Encode(root)
+		if !errors.Is(err, ErrBudgetExceeded) {
+			t.Errorf("limit %d: %v", limit, err)
+		}
+		if int64(buf.Len()) > limit {
+			t.Errorf("limit %d: wrote %d bytes", limit, buf.Len())
+		}
+		if limit > 1 && buf.Len() == 0 {
+			t.Errorf("limit %d: encoding was not aborted partway", limit)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"import.name/pan"
+)
+
+// isStructKeyType checks if t is a struct type which can be used as a map key
+// with Options.StructMapKeys.
+func isStructKeyType(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && !isTextKeyType(t) && !containsReferences(t)
+}
+
+// containsReferences checks if values of type t may refer to other values.
+func containsReferences(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Array:
+		return containsReferences(t.Elem())
+
+	case reflect.Struct:
+		for i := range t.NumField() {
+			if containsReferences(t.Field(i).Type) {
+				return true
+			}
+		}
+		return false
+
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Pointer, reflect.Slice, reflect.UnsafePointer:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// marshalStructKeys returns map keys and their JSON forms, sorted by JSON.
+// Distinct keys with the same JSON form (due to fields which are not
+// marshaled) are an error.
+func (m *marshaler) marshalStructKeys(keys []reflect.Value) ([]reflect.Value, []reflect.Value) {
+	km := newMarshaler(m.types, m.opts)
+	km.opts.InternValues = false
+
+	texts := make([]string, len(keys))
+	for i, key := range keys {
+		x, ok := km.marshal(key, false)
+		if !ok {
+			pan.Panic(fmt.Errorf("marshal: map key %w", &UnsupportedTypeError{key.Type()}))
+		}
+
+		b, err := json.Marshal(x)
+		if err != nil {
+			pan.Panic(fmt.Errorf("marshal: %s map key: %w", key.Type(), err))
+		}
+		texts[i] = string(b)
+	}
+
+	keys, values := sortKeyTexts(keys, texts)
+	for i := 1; i < len(values); i++ {
+		if s := values[i].String(); s == values[i-1].String() {
+			pan.Panic(fmt.Errorf("marshal: %s map keys have the same encoding: %s", keys[i].Type(), s))
+		}
+	}
+	return keys, values
+}
+
+// sortKeyTexts sorts map keys by their string forms, and returns the sorted
+// keys and strings.
+func sortKeyTexts(keys []reflect.Value, texts []string) ([]reflect.Value, []reflect.Value) {
+	type pair struct {
+		key  reflect.Value
+		text string
+	}
+
+	pairs := make([]pair, len(keys))
+	for i, key := range keys {
+		pairs[i] = pair{key, texts[i]}
+	}
+
+	slices.SortFunc(pairs, func(a, b pair) int {
+		return cmp.Compare(a.text, b.text)
+	})
+
+	values := make([]reflect.Value, len(pairs))
+	for i, p := range pairs {
+		keys[i] = p.key
+		values[i] = reflect.ValueOf(p.text)
+	}
+	return keys, values
+}
+
+// unmarshalStructKey decodes a map key encoded by marshalStructKeys.
+func (u *unmarshaler) unmarshalStructKey(s string, t reflect.Type) reflect.Value {
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+
+	var x any
+	if err := d.Decode(&x); err != nil {
+		pan.Panic(fmt.Errorf("unmarshal: invalid %s map key: %q", t, s))
+	}
+
+	key := reflect.New(t).Elem()
+	u.unmarshal(reflect.ValueOf(convertJSONNumbers(x)), key)
+	return key
+}
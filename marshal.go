@@ -4,45 +4,199 @@
 package marshal
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
+	"slices"
 	"unsafe"
 
 	"import.name/pan"
 )
 
 func Marshal(x any, types *Types, ignoreUnsupportedTypes bool) ([]any, error) {
+	return MarshalOptions(x, types, Options{IgnoreUnsupportedTypes: ignoreUnsupportedTypes})
+}
+
+func MarshalOptions(x any, types *Types, opts Options) ([]any, error) {
 	v := reflect.ValueOf(x)
 	if v.Kind() == reflect.Struct {
 		return nil, errors.New("marshal: struct passed as value")
 	}
 
-	m := &marshaler{
-		strict: !ignoreUnsupportedTypes,
-		types:  types,
-		refs:   make(map[unsafe.Pointer]int),
+	return marshalRoot(v, types, opts, nil)
+}
+
+// MarshalValue is like Marshal, but x may also be a struct or another
+// non-pointer value.  The value is copied into a new variable which becomes
+// object 0, so pointers within the graph which refer to the original variable
+// are marshaled as a separate object.
+func MarshalValue(x any, types *Types, ignoreUnsupportedTypes bool) ([]any, error) {
+	opts := Options{IgnoreUnsupportedTypes: ignoreUnsupportedTypes}
+
+	v := reflect.ValueOf(x)
+	if !v.IsValid() || v.Kind() == reflect.Pointer {
+		return MarshalOptions(x, types, opts)
 	}
 
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	return marshalRoot(p, types, opts, nil)
+}
+
+// Validate checks that x can be marshaled with the given options, without
+// producing output: the graph is traversed like by MarshalOptions, but the
+// marshaled structs, slices and maps are not built.  Transform is not called,
+// readers are not captured, and Options.OnMarshaled, Options.Manifest and
+// Options.RefCounts are ignored.
+func Validate(x any, types *Types, opts Options) error {
+	_, err := marshalDiscard(x, types, opts)
+	return err
+}
+
+// EstimateSize traverses x like Validate, and returns the number of objects
+// which MarshalOptions would produce.  The byte count is a rough estimate of
+// the encoded size: the lengths of strings, field names, map keys and type
+// names, plus 8 bytes per number, boolean or reference.  Sizes of captured
+// readers and transformed fields are not known.
+func EstimateSize(x any, types *Types, opts Options) (objects int, bytes int, err error) {
+	m, err := marshalDiscard(x, types, opts)
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(m.objects), m.size, nil
+}
+
+func marshalDiscard(x any, types *Types, opts Options) (*marshaler, error) {
+	v := reflect.ValueOf(x)
+	if v.Kind() == reflect.Struct {
+		return nil, errors.New("marshal: struct passed as value")
+	}
+
+	opts.OnMarshaled = nil
+	opts.Manifest = nil
+	opts.RefCounts = nil
+
+	m := newMarshaler(types, opts)
+	m.discard = true
+
 	if err := pan.Recover(func() {
 		if _, ok := m.marshal(v, true); !ok {
-			pan.Panic(errors.New("marshal: type not supported"))
+			pan.Panic(fmt.Errorf("marshal: %w", &UnsupportedTypeError{v.Type()}))
 		}
 	}); err != nil {
-		return nil, err
+		return nil, m.path.wrap("marshal: ", err)
+	}
+	return m, nil
+}
+
+// MarshalAppend is like MarshalOptions, but it appends the object list to dst
+// and returns the extended slice.  Object indexes are relative to the start of
+// the appended list.  Passing dst[:0] reuses its capacity.
+func MarshalAppend(dst []any, x any, types *Types, opts Options) ([]any, error) {
+	v := reflect.ValueOf(x)
+	if v.Kind() == reflect.Struct {
+		return dst, errors.New("marshal: struct passed as value")
+	}
+
+	objects, err := marshalRoot(v, types, opts, dst[len(dst):])
+	if err != nil {
+		return dst, err
+	}
+
+	return append(dst, objects...), nil
+}
+
+// MarshalEnvelope is like MarshalOptions, but the root object is wrapped in a
+// type-name envelope.  The type of x must be registered.  See UnmarshalAny.
+func MarshalEnvelope(x any, types *Types, opts Options) ([]any, error) {
+	if x != nil {
+		t := reflect.TypeOf(x)
+		if _, found, err := types.nameFor(t); err != nil {
+			return nil, err
+		} else if !found {
+			return nil, fmt.Errorf("marshal: %w", &UnregisteredTypeError{Type: t})
+		}
+	}
+
+	return marshalRoot(reflect.ValueOf(&x).Elem(), types, opts, nil)
+}
+
+func marshalRoot(v reflect.Value, types *Types, opts Options, objects []any) ([]any, error) {
+	m := newMarshaler(types, opts)
+	m.objects = objects
+	if opts.RefCounts != nil {
+		m.refCounts = make(map[int]int)
+	}
+
+	if err := pan.Recover(func() {
+		if _, ok := m.marshal(v, true); !ok {
+			pan.Panic(fmt.Errorf("marshal: %w", &UnsupportedTypeError{v.Type()}))
+		}
+	}); err != nil {
+		return nil, m.path.wrap("marshal: ", err)
+	}
+
+	if opts.OnMarshaled != nil {
+		if err := opts.OnMarshaled(m.objects); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.RefCounts != nil {
+		*opts.RefCounts = m.refCounts
+	}
+
+	if opts.Manifest != nil {
+		names := make([]string, 0, len(m.names))
+		for name := range m.names {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		*opts.Manifest = names
 	}
 
 	return m.objects, nil
 }
 
 type marshaler struct {
-	strict  bool
-	types   *Types
-	refs    map[unsafe.Pointer]int
-	objects []any
+	opts      Options
+	depth     int
+	path      path
+	inline    bool // Don't intern the next value.
+	discard   bool // Validation only: don't build structs, slices or maps.
+	size      int  // Estimated encoding size.
+	types     *Types
+	names     map[string]struct{} // Type names written.
+	refCounts map[int]int
+	refs      map[ref]int
+	base      map[ref]int // Indexes assigned by a previous snapshot.
+	interned  map[string]int
+	objects   []any
+}
+
+func newMarshaler(types *Types, opts Options) *marshaler {
+	return &marshaler{
+		opts:  opts.resolve(),
+		types: types,
+		names: make(map[string]struct{}),
+		refs:  make(map[ref]int),
+	}
 }
 
 func (m *marshaler) marshal(v reflect.Value, init bool) (any, bool) {
+	if m.opts.MaxDepth > 0 {
+		if m.depth >= m.opts.MaxDepth {
+			pan.Panic(errors.New("marshal: max depth exceeded"))
+		}
+		m.depth++
+		defer func() { m.depth-- }()
+	}
+
+	inline := init || m.inline
+	m.inline = false
+
 	switch v.Kind() {
 	case reflect.Interface, reflect.Map, reflect.Pointer, reflect.Slice:
 		if v.IsNil() {
@@ -53,22 +207,100 @@ func (m *marshaler) marshal(v reflect.Value, init bool) (any, bool) {
 		}
 	}
 
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		// Hooks are invoked for the referenced value.
+	default:
+		beforeMarshal(v)
+
+		if r, ok := marshalGraph(v); ok {
+			return m.marshal(r, init)
+		}
+
+		if s, ok := marshalText(v); ok {
+			m.size += len(s)
+			if init {
+				m.objects = append(m.objects, s)
+			}
+			return s, true
+		}
+	}
+
 	switch v.Kind() {
 	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr, reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128, reflect.String:
+		if v.Kind() == reflect.String && m.opts.InternValues && !inline {
+			return m.intern(v.String()), true
+		}
+		m.size += leafSize(v)
+		if (v.Kind() == reflect.Complex64 || v.Kind() == reflect.Complex128) && m.opts.ComplexPairs {
+			c := v.Complex()
+			pair := []any{real(c), imag(c)}
+			if init {
+				m.objects = append(m.objects, pair)
+			}
+			return pair, true
+		}
 		if init {
 			m.objects = append(m.objects, v.Interface())
 		}
 		return v.Interface(), true
 
 	case reflect.Struct:
-		fields := reflect.VisibleFields(v.Type())
-		marshaled := make(map[string]any, len(fields))
+		if v.Type() == syncMapType {
+			r, err := syncMapEntries(v)
+			if err != nil {
+				pan.Panic(fmt.Errorf("marshal: %w", err))
+			}
+			return m.marshal(r, init)
+		}
+
+		unexported := m.opts.IncludeUnexported || m.types.allowsUnexported(v.Type())
+		if unexported && !v.CanAddr() {
+			tmp := reflect.New(v.Type()).Elem()
+			tmp.Set(v)
+			v = tmp
+		}
+
+		fields, err := structFields(v.Type(), m.opts.TagKey)
+		if err != nil {
+			pan.Panic(err)
+		}
+
+		var marshaled map[string]any
+		if !m.discard {
+			marshaled = make(map[string]any, len(fields))
+		}
 
 		for _, f := range fields {
-			if f.IsExported() {
-				if x, ok := m.marshal(v.FieldByIndex(f.Index), false); ok && x != nil {
-					marshaled[f.Name] = x
+			if (f.IsExported() || unexported) && f.via == "" && f.selected(v) {
+				field, err := v.FieldByIndexErr(f.Index)
+				if err != nil {
+					continue // Nil embedded pointer.
+				}
+				if !field.CanInterface() {
+					field = unsafeField(field)
 				}
+				if f.omitEmpty && isEmpty(field) {
+					continue
+				}
+
+				m.path.pushField(f.name)
+				intern := m.opts.InternValues
+				if f.transform {
+					m.opts.InternValues = false // Keep the plaintext within the field.
+				}
+				x, ok := m.marshal(field, false)
+				m.opts.InternValues = intern
+				if ok && (x != nil || m.opts.ExplicitNull) {
+					if f.transform {
+						x = m.transformField(f, x)
+					}
+					if !m.discard {
+						marshaled[f.name] = x
+					}
+					m.size += len(f.name)
+				}
+				m.path.pop()
 			}
 		}
 
@@ -78,12 +310,35 @@ func (m *marshaler) marshal(v reflect.Value, init bool) (any, bool) {
 		return marshaled, true
 
 	case reflect.Array, reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			s := marshalBytes(v)
+			if m.opts.InternValues && !inline {
+				return m.intern(s), true
+			}
+			m.size += len(s)
+			if init {
+				m.objects = append(m.objects, s)
+			}
+			return s, true
+		}
+
+		if m.opts.HomogeneousInterfaceSlices && v.Type().Elem().Kind() == reflect.Interface {
+			if x, ok := m.marshalHomogeneous(v, init); ok {
+				return x, true
+			}
+		}
+
 		t := reflect.SliceOf(reflect.TypeFor[any]())
 		n := v.Len()
-		marshaled := reflect.MakeSlice(t, n, n)
+		marshaled := reflect.Zero(t)
+		if !m.discard {
+			marshaled = reflect.MakeSlice(t, n, n)
+		}
 
 		for i := range n {
+			m.path.pushIndex(i)
 			x, ok := m.marshal(v.Index(i), false)
+			m.path.pop()
 			if !ok {
 				if i > 0 {
 					panic("failed to marshal secondary slice element")
@@ -91,7 +346,7 @@ func (m *marshaler) marshal(v reflect.Value, init bool) (any, bool) {
 				return nil, false
 			}
 
-			if x != nil {
+			if x != nil && !m.discard {
 				marshaled.Index(i).Set(reflect.ValueOf(x))
 			}
 		}
@@ -103,25 +358,77 @@ func (m *marshaler) marshal(v reflect.Value, init bool) (any, bool) {
 
 	case reflect.Map:
 		keyType := v.Type().Key()
-		if !isMapKeyTypeSupported(keyType) {
-			if m.strict {
-				pan.Panic(fmt.Errorf("marshal: type not supported: %s", v.Type()))
+		structKeys := m.opts.StructMapKeys && keyType.Kind() == reflect.Struct && !isTextKeyType(keyType)
+		if structKeys && !isStructKeyType(keyType) {
+			pan.Panic(fmt.Errorf("marshal: map key type contains pointers or interfaces: %s", keyType))
+		}
+		if !isMapKeyTypeSupported(keyType) && !structKeys {
+			if !m.opts.IgnoreUnsupportedTypes {
+				pan.Panic(fmt.Errorf("marshal: %w", &UnsupportedTypeError{v.Type()}))
 			}
 			return nil, false
 		}
 
+		keys := v.MapKeys()
+		var texts []reflect.Value // Marshaled keys, if different.
+		if isTextKeyType(keyType) {
+			keys, texts = marshalTextKeys(keys)
+			keyType = reflect.TypeFor[string]()
+		} else if structKeys {
+			keys, texts = m.marshalStructKeys(keys)
+			keyType = reflect.TypeFor[string]()
+		} else if m.opts.SortMapKeys || m.opts.MapAsEntries {
+			sortMapKeys(keys)
+		}
+
+		if m.opts.MapAsEntries {
+			entries := make([]any, 0, len(keys))
+
+			for i, key := range keys {
+				out := key
+				if texts != nil {
+					out = texts[i]
+				}
+
+				m.path.pushKey(key)
+				if x, ok := m.marshal(v.MapIndex(key), false); ok {
+					entries = append(entries, []any{out.Interface(), x})
+					m.size += leafSize(out)
+				}
+				m.path.pop()
+			}
+
+			if init {
+				m.objects = append(m.objects, entries)
+			}
+			return entries, true
+		}
+
 		elemType := reflect.TypeFor[any]()
 		mapType := reflect.MapOf(keyType, elemType)
-		marshaled := reflect.MakeMapWithSize(mapType, v.Len())
+		marshaled := reflect.Zero(mapType)
+		if !m.discard {
+			marshaled = reflect.MakeMapWithSize(mapType, v.Len())
+		}
+
+		for i, key := range keys {
+			out := key
+			if texts != nil {
+				out = texts[i]
+			}
 
-		for iter := v.MapRange(); iter.Next(); {
-			if x, ok := m.marshal(iter.Value(), false); ok {
-				if x == nil {
-					marshaled.SetMapIndex(iter.Key(), reflect.Zero(elemType))
+			m.path.pushKey(key)
+			if x, ok := m.marshal(v.MapIndex(key), false); ok {
+				m.size += leafSize(out)
+				if m.discard {
+					// Not built.
+				} else if x == nil {
+					marshaled.SetMapIndex(out, reflect.Zero(elemType))
 				} else {
-					marshaled.SetMapIndex(iter.Key(), reflect.ValueOf(x))
+					marshaled.SetMapIndex(out, reflect.ValueOf(x))
 				}
 			}
+			m.path.pop()
 		}
 
 		if init {
@@ -130,47 +437,332 @@ func (m *marshaler) marshal(v reflect.Value, init bool) (any, bool) {
 		return marshaled.Interface(), true
 
 	case reflect.Interface:
-		v := v.Elem()
-		t := v.Type()
+		if m.opts.CaptureReaders && isCapturedReaderType(v.Type()) {
+			if m.discard {
+				return nil, true // Don't consume the reader.
+			}
 
-		name, found := m.types.typeNames[t]
+			s, err := captureReader(v.Elem().Interface().(io.Reader), m.opts.MaxBytes)
+			if err != nil {
+				pan.Panic(fmt.Errorf("marshal: %s: %w", v.Type(), err))
+			}
+
+			if init {
+				m.objects = append(m.objects, s)
+			}
+			return s, true
+		}
+
+		if m.opts.UnwrapSingleImpl && v.NumMethod() > 0 {
+			impl, n, err := m.types.implementation(v.Type())
+			if err != nil {
+				pan.Panic(err)
+			}
+
+			// Nil pointers keep the wrapper so that they aren't mistaken for
+			// nil interfaces.
+			if n == 1 && impl == v.Elem().Type() && !(impl.Kind() == reflect.Pointer && v.Elem().IsNil()) {
+				x, ok := m.marshal(v.Elem(), init)
+				if !ok {
+					panic("failed to marshal registered type")
+				}
+				return x, true
+			}
+		}
+
+		elem := v.Elem()
+		t := elem.Type()
+
+		name, found, err := m.types.nameFor(t)
+		if err != nil {
+			pan.Panic(err)
+		}
 		if !found {
-			pan.Panic(fmt.Errorf("marshal: type not registered: %s", t))
+			if c := m.types.codecFor(t); c != nil {
+				r, err := c.encode(elem)
+				if err != nil {
+					pan.Panic(fmt.Errorf("marshal: %s: %w", t, err))
+				}
+
+				index := len(m.objects)
+				if init {
+					m.objects = append(m.objects, nil) // Placeholder.
+				}
+
+				x, ok := m.marshal(r, false)
+				if !ok {
+					panic("failed to marshal codec representation")
+				}
+
+				marshaled := wrap(c.name, x, m.opts.ExplicitWrappers)
+				m.size += len(c.name)
+				m.names[c.name] = struct{}{}
+				if init {
+					m.objects[index] = marshaled
+				}
+				return marshaled, true
+			}
+
+			if v.NumMethod() == 0 && isGenericType(t) {
+				// Generic value without type information.
+				m.inline = true
+				return m.marshal(elem, init)
+			}
+			pan.Panic(fmt.Errorf("marshal: %w", &UnregisteredTypeError{Type: t}))
 		}
 
-		x, ok := m.marshal(v, false)
+		index := len(m.objects)
+		if init {
+			m.objects = append(m.objects, nil) // Placeholder.
+		}
+
+		x, ok := m.marshal(elem, false)
 		if !ok {
 			panic("failed to marshal registered type")
 		}
 
-		marshaled := map[string]any{name: x}
+		marshaled := wrap(name, x, m.opts.ExplicitWrappers)
+		m.size += len(name)
+		m.names[name] = struct{}{}
 		if init {
-			m.objects = append(m.objects, marshaled)
+			m.objects[index] = marshaled
 		}
 		return marshaled, true
 
 	case reflect.Pointer:
-		ptr := v.UnsafePointer()
+		ptr := ref{v.UnsafePointer(), v.Type()}
 		if index, found := m.refs[ptr]; found {
+			if m.opts.RequireTree {
+				pan.Panic(fmt.Errorf("marshal: pointer is shared: %s", v.Type()))
+			}
+			if m.refCounts != nil {
+				m.refCounts[index]++
+			}
+			m.size += 8
 			return index, true
 		}
 
-		index := len(m.objects)
+		index, reused := m.base[ptr]
+		if !reused {
+			index = len(m.objects)
+			m.objects = append(m.objects, nil) // Placeholder.
+		}
 		m.refs[ptr] = index
-		m.objects = append(m.objects, nil) // Placeholder.
 
+		m.inline = true
 		if x, ok := m.marshal(v.Elem(), false); ok {
 			m.objects[index] = x
+			m.size += 8
+			if m.refCounts != nil && !init {
+				m.refCounts[index]++ // Not the root.
+			}
 			return index, true
 		}
 
-		m.objects = m.objects[:index]
+		delete(m.refs, ptr)
+		if !reused {
+			m.objects = m.objects[:index]
+		}
+		return nil, false
+
+	case reflect.Chan:
+		if m.opts.SnapshotChannels && v.Type().ChanDir() == reflect.BothDir {
+			if v.IsNil() {
+				if init {
+					m.objects = append(m.objects, nil)
+				}
+				return nil, true
+			}
+
+			return m.marshal(snapshotChannel(v), init)
+		}
+
+		if !m.opts.IgnoreUnsupportedTypes {
+			pan.Panic(fmt.Errorf("marshal: %w", &UnsupportedTypeError{v.Type()}))
+		}
+		return nil, false
+
+	default:
+		if !m.opts.IgnoreUnsupportedTypes {
+			pan.Panic(fmt.Errorf("marshal: %w", &UnsupportedTypeError{v.Type()}))
+		}
 		return nil, false
+	}
+}
+
+func (m *marshaler) transformField(f field, x any) any {
+	if m.opts.Transform == nil {
+		pan.Panic(errors.New("marshal: no transform for encrypted field"))
+	}
+
+	if m.discard {
+		return x
+	}
+
+	x, err := m.opts.Transform(m.path.String(), f.tag, x)
+	if err != nil {
+		pan.Panic(fmt.Errorf("marshal: %w", err))
+	}
+	return x
+}
+
+// ref identifies a pointer.  The type is included because pointers to a struct
+// and to its first field have the same address.
+type ref struct {
+	ptr unsafe.Pointer
+	t   reflect.Type
+}
 
+// isGenericType checks if values of type t can be held by empty interfaces
+// without type-name wrappers: they are unmarshaled as values of the same types.
+func isGenericType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr, reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128, reflect.String:
+		return t.PkgPath() == "" // Predeclared.
+	default:
+		return t == genericSliceType || t == genericMapType
+	}
+}
+
+var (
+	genericSliceType = reflect.TypeFor[[]any]()
+	genericMapType   = reflect.TypeFor[map[string]any]()
+)
+
+// leafSize estimates the encoded size of a scalar value.
+func leafSize(v reflect.Value) int {
+	switch v.Kind() {
+	case reflect.String:
+		return len(v.String())
+	case reflect.Complex64, reflect.Complex128:
+		return 16
 	default:
-		if m.strict {
-			pan.Panic(fmt.Errorf("marshal: type not supported: %s", v.Type()))
+		return 8
+	}
+}
+
+// intern returns the index of an object with the value s.
+func (m *marshaler) intern(s string) int {
+	m.size += 8
+	if index, found := m.interned[s]; found {
+		return index
+	}
+	m.size += len(s)
+
+	if m.interned == nil {
+		m.interned = make(map[string]int)
+	}
+	index := len(m.objects)
+	m.objects = append(m.objects, s)
+	m.interned[s] = index
+	return index
+}
+
+// marshalHomogeneous wraps the elements of an interface slice or array with a
+// single type name, if all elements have the same registered dynamic type.
+func (m *marshaler) marshalHomogeneous(v reflect.Value, init bool) (any, bool) {
+	n := v.Len()
+	if n == 0 {
+		return nil, false
+	}
+
+	var t reflect.Type
+
+	for i := range n {
+		elem := v.Index(i)
+		if elem.IsNil() {
+			return nil, false
 		}
+		if i == 0 {
+			t = elem.Elem().Type()
+		} else if elem.Elem().Type() != t {
+			return nil, false
+		}
+	}
+
+	name, found, err := m.types.nameFor(t)
+	if err != nil {
+		pan.Panic(err)
+	}
+	if !found {
 		return nil, false
 	}
+
+	index := len(m.objects)
+	if init {
+		m.objects = append(m.objects, nil) // Placeholder.
+	}
+
+	elems := make([]any, n)
+
+	for i := range n {
+		m.path.pushIndex(i)
+		x, ok := m.marshal(v.Index(i).Elem(), false)
+		m.path.pop()
+		if !ok {
+			panic("failed to marshal registered type")
+		}
+		elems[i] = x
+	}
+
+	marshaled := wrap(name, elems, m.opts.ExplicitWrappers)
+	m.size += len(name)
+	m.names[name] = struct{}{}
+	if init {
+		m.objects[index] = marshaled
+	}
+	return marshaled, true
+}
+
+// sortMapKeys sorts integer keys numerically and string keys lexically.
+func sortMapKeys(keys []reflect.Value) {
+	if len(keys) == 0 {
+		return
+	}
+
+	switch keys[0].Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		slices.SortFunc(keys, func(a, b reflect.Value) int {
+			return cmp.Compare(a.Int(), b.Int())
+		})
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		slices.SortFunc(keys, func(a, b reflect.Value) int {
+			return cmp.Compare(a.Uint(), b.Uint())
+		})
+
+	case reflect.String:
+		slices.SortFunc(keys, func(a, b reflect.Value) int {
+			return cmp.Compare(a.String(), b.String())
+		})
+	}
+}
+
+// snapshotChannel drains the buffered elements of a channel into a slice, and
+// sends them back to the channel.
+func snapshotChannel(v reflect.Value) reflect.Value {
+	n := v.Len()
+	elems := reflect.MakeSlice(reflect.SliceOf(v.Type().Elem()), 0, n)
+
+	for range n {
+		x, ok := v.TryRecv()
+		if !ok {
+			break
+		}
+		elems = reflect.Append(elems, x)
+	}
+
+	for i := range elems.Len() {
+		if !v.TrySend(elems.Index(i)) {
+			break
+		}
+	}
+
+	return elems
+}
+
+// unsafeField circumvents the read-only restriction of an addressable value
+// obtained via an unexported struct field.
+func unsafeField(v reflect.Value) reflect.Value {
+	return reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
 }
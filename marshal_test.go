@@ -4,8 +4,16 @@
 package marshal
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io"
 	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 	"unsafe"
 )
@@ -52,16 +60,7 @@ type alt2 struct {
 
 func (*alt2) alt() {}
 
-func TestMarshal(t *testing.T) {
-	types := NewTypes()
-
-	if err := types.Register(
-		TypeName(alt1{}),
-		Type("alt2ptr", &alt2{}),
-	); err != nil {
-		t.Fatal("type registration error:", err)
-	}
-
+func newTopLevel(types *Types) *topLevel {
 	x := &topLevel{
 		10,
 		20,
@@ -86,6 +85,20 @@ func TestMarshal(t *testing.T) {
 	x.StructIndirect.Parent = x
 	x.Self = x
 	x.Slice = []*topLevel{x, nil, x}[:2]
+	return x
+}
+
+func TestMarshal(t *testing.T) {
+	types := NewTypes()
+
+	if err := types.Register(
+		TypeName(alt1{}),
+		Type("alt2ptr", &alt2{}),
+	); err != nil {
+		t.Fatal("type registration error:", err)
+	}
+
+	x := newTopLevel(types)
 
 	objects, err := Marshal(x, types, true)
 	if err != nil {
@@ -119,3 +132,1779 @@ func TestMarshal(t *testing.T) {
 		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
 	}
 }
+
+func TestNestedInterfaceMap(t *testing.T) {
+	types := NewTypes().MustRegister(
+		TypeName(alt1{}),
+		Type("alt2ptr", &alt2{}),
+	)
+
+	type config struct {
+		Tree map[string]map[string]alt
+	}
+
+	shared := &alt2{"shared"}
+
+	x := &config{
+		map[string]map[string]alt{
+			"a": {
+				"1":   alt1{"a1"},
+				"2":   shared,
+				"nil": nil,
+			},
+			"b": {
+				"2": shared,
+			},
+			"empty": {},
+			"nil":   nil,
+		},
+	}
+
+	objects, err := Marshal(x, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	y := new(config)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+	if y.Tree["a"]["2"] != y.Tree["b"]["2"] {
+		t.Error("shared pointer was not preserved")
+	}
+}
+
+func TestOnMarshaled(t *testing.T) {
+	type node struct {
+		Value int
+		Next  *node
+	}
+
+	x := &node{1, &node{2, nil}}
+	rejection := errors.New("too many objects")
+
+	opts := Options{
+		OnMarshaled: func(objects []any) error {
+			if len(objects) > 1 {
+				return rejection
+			}
+			return nil
+		},
+	}
+
+	if _, err := MarshalOptions(x, NewTypes(), opts); err != rejection {
+		t.Error("unexpected error:", err)
+	}
+
+	x.Next = nil
+
+	objects, err := MarshalOptions(x, NewTypes(), opts)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if len(objects) != 1 {
+		t.Error("wrong number of objects:", len(objects))
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	types := NewTypes().MustRegister(
+		TypeName(alt1{}),
+		Type("alt2ptr", &alt2{}),
+		TypeName(event{}),
+		Type("eventPtr", &event{}),
+	)
+
+	cycle := &event{Seq: 1}
+	cycle.Next = cycle
+
+	for _, x := range []any{
+		alt1{"value"},
+		&alt2{"pointer"},
+		event{2, &event{Seq: 3}},
+		cycle,
+		nil,
+	} {
+		objects, err := MarshalEnvelope(x, types, Options{})
+		if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+
+		y, err := UnmarshalAny(objects, types)
+		if err != nil {
+			t.Fatal("unmarshal error:", err)
+		}
+
+		if !reflect.DeepEqual(x, y) {
+			t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+		}
+	}
+
+	if _, err := MarshalEnvelope(subLevel{}, types, Options{}); err == nil {
+		t.Error("unregistered type was marshaled")
+	}
+}
+
+func TestSnapshotChannels(t *testing.T) {
+	type queue struct {
+		Pending chan *event
+		Nil     chan int
+		Recv    <-chan int
+	}
+
+	shared := &event{Seq: 1}
+
+	x := &queue{
+		Pending: make(chan *event, 10),
+		Recv:    make(chan int, 1),
+	}
+	x.Pending <- shared
+	x.Pending <- &event{Seq: 2}
+	x.Pending <- shared
+
+	if _, err := Marshal(x, NewTypes(), false); err == nil {
+		t.Error("channel marshaled without SnapshotChannels option")
+	}
+
+	objects, err := MarshalOptions(x, NewTypes(), Options{
+		IgnoreUnsupportedTypes: true,
+		SnapshotChannels:       true,
+	})
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	root := objects[0].(map[string]any)
+	if !reflect.DeepEqual(root["Pending"], []any{1, 2, 1}) {
+		t.Errorf("pending: %#v", root["Pending"])
+	}
+	if _, found := root["Nil"]; found {
+		t.Error("nil channel was marshaled")
+	}
+	if _, found := root["Recv"]; found {
+		t.Error("receive-only channel was marshaled")
+	}
+
+	if n := len(x.Pending); n != 3 {
+		t.Fatal("channel length after snapshot:", n)
+	}
+	for _, seq := range []int{1, 2, 1} {
+		if e := <-x.Pending; e.Seq != seq {
+			t.Error("channel order changed:", e.Seq)
+		}
+	}
+}
+
+func TestSortMapKeys(t *testing.T) {
+	type index struct {
+		Signed   map[int]*event
+		Unsigned map[uint8]*event
+		Strings  map[string]*event
+	}
+
+	x := &index{
+		Signed:   make(map[int]*event),
+		Unsigned: make(map[uint8]*event),
+		Strings:  make(map[string]*event),
+	}
+
+	var expect []int
+
+	for _, i := range []int{-1, 10, 2, 0, 11, 1, 9} {
+		x.Signed[i] = &event{Seq: i}
+	}
+	expect = append(expect, -1, 0, 1, 2, 9, 10, 11)
+
+	for _, i := range []uint8{200, 3, 30} {
+		x.Unsigned[i] = &event{Seq: int(i)}
+	}
+	expect = append(expect, 3, 30, 200)
+
+	for _, s := range []string{"b10", "a", "b2"} {
+		x.Strings[s] = &event{Seq: len(s)}
+	}
+	expect = append(expect, 1, 3, 2)
+
+	for range 10 {
+		objects, err := MarshalOptions(x, NewTypes(), Options{SortMapKeys: true})
+		if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+
+		var order []int
+		for _, obj := range objects[1:] {
+			order = append(order, obj.(map[string]any)["Seq"].(int))
+		}
+
+		if !reflect.DeepEqual(order, expect) {
+			t.Fatal("order:", order)
+		}
+	}
+}
+
+type shape interface {
+	area() float64
+}
+
+type square struct {
+	Side float64
+}
+
+func (s square) area() float64 { return s.Side * s.Side }
+
+func TestUnwrapSingleImpl(t *testing.T) {
+	type drawing struct {
+		Shape  shape
+		Shapes []shape
+		Alt    alt
+	}
+
+	types := NewTypes().MustRegister(
+		TypeName(square{}),
+		TypeName(alt1{}),
+		Type("alt2ptr", &alt2{}),
+	)
+	opts := Options{UnwrapSingleImpl: true}
+
+	x := &drawing{
+		Shape:  square{2},
+		Shapes: []shape{square{3}, nil},
+		Alt:    &alt2{"wrapped"},
+	}
+
+	objects, err := MarshalOptions(x, types, opts)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	root := objects[0].(map[string]any)
+	if !reflect.DeepEqual(root["Shape"], map[string]any{"Side": 2.0}) {
+		t.Errorf("shape: %#v", root["Shape"])
+	}
+	if !reflect.DeepEqual(root["Alt"], map[string]any{"alt2ptr": 1}) {
+		t.Errorf("alt: %#v", root["Alt"])
+	}
+
+	y := new(drawing)
+	if err := UnmarshalOptions(objects, y, types, opts); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+
+	root["Alt"] = map[string]any{"Alt1": "bare"}
+	if err := UnmarshalOptions(objects, new(drawing), types, opts); err == nil {
+		t.Error("bare value of ambiguous interface type was unmarshaled")
+	}
+
+	// A nil pointer keeps its wrapper so that it isn't decoded as a nil interface.
+	ptrTypes := NewTypes().MustRegister(Type("alt2ptr", &alt2{}))
+	for _, x := range []*drawing{{Alt: &alt2{"bare"}}, {Alt: (*alt2)(nil)}, {}} {
+		objects, err := MarshalOptions(x, ptrTypes, opts)
+		if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+
+		y := new(drawing)
+		if err := UnmarshalOptions(objects, y, ptrTypes, opts); err != nil {
+			t.Fatal("unmarshal error:", err)
+		}
+		if !reflect.DeepEqual(x, y) || (x.Alt == nil) != (y.Alt == nil) {
+			t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+		}
+	}
+
+	// Empty interfaces are implemented by every type, so they are not unwrapped.
+	type generic struct {
+		X any
+		Y any
+		Z any
+	}
+
+	for _, types := range []*Types{NewTypes().MustRegister(TypeName(square{})), types} {
+		x := &generic{5, "s", square{4}}
+
+		objects, err := MarshalOptions(x, types, opts)
+		if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+
+		y := new(generic)
+		if err := UnmarshalOptions(objects, y, types, opts); err != nil {
+			t.Fatal("unmarshal error:", err)
+		}
+		if !reflect.DeepEqual(x, y) {
+			t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+		}
+	}
+}
+
+type refNode struct {
+	Name     string
+	Refs     int // Number of incoming references, stored explicitly.
+	Children []*refNode
+}
+
+func TestRefCountedGraph(t *testing.T) {
+	a := &refNode{Name: "a"}
+	b := &refNode{Name: "b"}
+	c := &refNode{Name: "c"}
+	root := &refNode{Name: "root", Children: []*refNode{a, b, a}}
+	a.Children = []*refNode{c}
+	b.Children = []*refNode{c, root}
+
+	countRefs := func(root *refNode) map[*refNode]int {
+		counts := make(map[*refNode]int)
+		visited := make(map[*refNode]bool)
+
+		var walk func(*refNode)
+		walk = func(n *refNode) {
+			if visited[n] {
+				return
+			}
+			visited[n] = true
+			for _, child := range n.Children {
+				counts[child]++
+				walk(child)
+			}
+		}
+		walk(root)
+		return counts
+	}
+
+	for n, count := range countRefs(root) {
+		n.Refs = count
+	}
+
+	objects, err := Marshal(root, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	y := new(refNode)
+	if err := Unmarshal(objects, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	// Stored counters round-trip as plain integers, and they agree with
+	// the reconstructed sharing structure.  A counter which is derived from
+	// the graph structure should instead be recomputed after decoding.
+	counts := countRefs(y)
+	if len(counts) != 4 {
+		t.Error("distinct nodes:", len(counts))
+	}
+	for n, count := range counts {
+		if n.Refs != count {
+			t.Errorf("%s: stored %d references, found %d", n.Name, n.Refs, count)
+		}
+	}
+	if y.Children[0] != y.Children[2] || y.Children[1].Children[1] != y {
+		t.Error("sharing was not preserved")
+	}
+}
+
+type hookedList struct {
+	Items   []hookedItem
+	Parent  *hookedList
+	Invalid bool
+
+	index map[string]int
+}
+
+func (l *hookedList) BeforeMarshal() error {
+	if l.Invalid {
+		return errors.New("invalid list")
+	}
+	return nil
+}
+
+func (l *hookedList) AfterUnmarshal() error {
+	if l.Invalid {
+		return errors.New("invalid list")
+	}
+
+	l.index = make(map[string]int)
+	for i, item := range l.Items {
+		l.index[item.Name] = i
+	}
+	return nil
+}
+
+type hookedItem struct {
+	Name    string
+	Flushed bool
+
+	decoded bool
+}
+
+func (i *hookedItem) BeforeMarshal() error {
+	i.Flushed = true
+	return nil
+}
+
+func (i *hookedItem) AfterUnmarshal() error {
+	i.decoded = true
+	return nil
+}
+
+func TestHooks(t *testing.T) {
+	x := &hookedList{
+		Items: []hookedItem{{Name: "a"}, {Name: "b"}},
+	}
+	x.Parent = x
+
+	objects, err := Marshal(x, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if !x.Items[0].Flushed || !x.Items[1].Flushed {
+		t.Error("BeforeMarshal was not called for nested values")
+	}
+
+	y := new(hookedList)
+	if err := Unmarshal(objects, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(y.index, map[string]int{"a": 0, "b": 1}) {
+		t.Error("index:", y.index)
+	}
+	if !y.Items[0].decoded || !y.Items[1].decoded || !y.Items[1].Flushed {
+		t.Errorf("items: %#v", y.Items)
+	}
+
+	x.Invalid = true
+
+	if _, err := Marshal(x, NewTypes(), false); err == nil || !strings.Contains(err.Error(), "invalid list") {
+		t.Error("BeforeMarshal error:", err)
+	}
+
+	objects[0].(map[string]any)["Invalid"] = true
+
+	if err := Unmarshal(objects, new(hookedList), NewTypes()); err == nil || !strings.Contains(err.Error(), "invalid list") {
+		t.Error("AfterUnmarshal error:", err)
+	}
+}
+
+type unionValue struct {
+	Kind int
+	Int  int      `marshal:",union=Kind"`
+	Str  string   `marshal:",union=Kind"`
+	List []string `marshal:",union=Kind"`
+	Note string
+}
+
+func TestUnion(t *testing.T) {
+	for _, x := range []*unionValue{
+		{Kind: 0, Int: 10, Note: "int"},
+		{Kind: 1, Str: "text"},
+		{Kind: 2, List: []string{"a", "b"}},
+		{Kind: 3},
+	} {
+		objects, err := Marshal(x, NewTypes(), false)
+		if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+
+		var keys []string
+		for key := range objects[0].(map[string]any) {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		expect := map[int][]string{
+			0: {"Int", "Kind", "Note"},
+			1: {"Kind", "Note", "Str"},
+			2: {"Kind", "List", "Note"},
+			3: {"Kind", "Note"},
+		}[x.Kind]
+		if !reflect.DeepEqual(keys, expect) {
+			t.Errorf("kind %d keys: %v", x.Kind, keys)
+		}
+
+		y := new(unionValue)
+		if err := Unmarshal(objects, y, NewTypes()); err != nil {
+			t.Fatal("unmarshal error:", err)
+		}
+		if !reflect.DeepEqual(x, y) {
+			t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+		}
+	}
+
+	// Inactive variants are ignored when unmarshaling.
+	sources := []any{map[string]any{"Kind": 1, "Int": 10, "Str": "text"}}
+
+	y := new(unionValue)
+	if err := Unmarshal(sources, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(y, &unionValue{Kind: 1, Str: "text"}) {
+		t.Errorf("unmarshaled: %#v", y)
+	}
+
+	type invalid struct {
+		Kind string
+		Int  int `marshal:",union=Kind"`
+	}
+
+	if _, err := Marshal(&invalid{}, NewTypes(), false); err == nil {
+		t.Error("non-integer discriminator was accepted")
+	}
+
+	type Disc struct {
+		Kind int
+	}
+	type embedded struct {
+		*Disc
+		Int int    `marshal:",union=Kind"`
+		Str string `marshal:",union=Kind"`
+	}
+
+	objects, err := Marshal(&embedded{Int: 5, Str: "inactive"}, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if !reflect.DeepEqual(objects[0], map[string]any{"Int": 5}) {
+		t.Errorf("marshaled: %#v", objects[0])
+	}
+
+	e := new(embedded)
+	if err := Unmarshal(objects, e, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(e, &embedded{Int: 5}) {
+		t.Errorf("unmarshaled: %#v", e)
+	}
+}
+
+func TestSnapshotChannelsRoundTrip(t *testing.T) {
+	type job struct {
+		ID   int
+		Name string
+	}
+
+	type worker struct {
+		Queue chan job
+		Empty chan job
+	}
+
+	x := &worker{
+		Queue: make(chan job, 5),
+		Empty: make(chan job, 5),
+	}
+	x.Queue <- job{1, "first"}
+	x.Queue <- job{2, "second"}
+
+	opts := Options{SnapshotChannels: true}
+
+	objects, err := MarshalOptions(x, NewTypes(), opts)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	if err := Unmarshal(objects, new(worker), NewTypes()); err == nil {
+		t.Error("channel unmarshaled without SnapshotChannels option")
+	}
+
+	y := new(worker)
+	if err := UnmarshalOptions(objects, y, NewTypes(), opts); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	if n := len(y.Queue); n != 2 {
+		t.Fatal("queue length:", n)
+	}
+	for _, expect := range []job{{1, "first"}, {2, "second"}} {
+		if j := <-y.Queue; j != expect {
+			t.Errorf("job: %#v", j)
+		}
+	}
+
+	if y.Empty == nil || len(y.Empty) != 0 {
+		t.Errorf("empty channel: %#v", y.Empty)
+	}
+}
+
+func TestRequireTree(t *testing.T) {
+	opts := Options{RequireTree: true}
+
+	leaf := &event{Seq: 2}
+	tree := &event{1, leaf}
+
+	if _, err := MarshalOptions(tree, NewTypes(), opts); err != nil {
+		t.Error("tree:", err)
+	}
+
+	type pair struct {
+		A *event
+		B *event
+	}
+
+	if _, err := MarshalOptions(&pair{leaf, leaf}, NewTypes(), opts); err == nil || !strings.Contains(err.Error(), "shared") {
+		t.Error("shared pointer:", err)
+	}
+	if _, err := MarshalOptions(&pair{leaf, leaf}, NewTypes(), Options{}); err != nil {
+		t.Error("shared pointer without option:", err)
+	}
+
+	leaf.Next = tree
+
+	if _, err := MarshalOptions(tree, NewTypes(), opts); err == nil {
+		t.Error("cycle was accepted")
+	}
+}
+
+func TestHomogeneousInterfaceSlices(t *testing.T) {
+	types := NewTypes().MustRegister(
+		TypeName(alt1{}),
+		Type("alt2ptr", &alt2{}),
+	)
+
+	type lists struct {
+		Same  []alt
+		Mixed []alt
+		Nils  []alt
+		Array [2]alt
+		Empty []alt
+	}
+
+	shared := &alt2{"shared"}
+
+	x := &lists{
+		Same:  []alt{alt1{"a"}, alt1{"b"}, alt1{"c"}},
+		Mixed: []alt{alt1{"a"}, shared},
+		Nils:  []alt{shared, nil},
+		Array: [2]alt{shared, shared},
+		Empty: []alt{},
+	}
+
+	objects, err := MarshalOptions(x, types, Options{HomogeneousInterfaceSlices: true})
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	root := objects[0].(map[string]any)
+
+	if !reflect.DeepEqual(root["Same"], map[string]any{"alt1": []any{
+		map[string]any{"Alt1": "a"},
+		map[string]any{"Alt1": "b"},
+		map[string]any{"Alt1": "c"},
+	}}) {
+		t.Errorf("same: %#v", root["Same"])
+	}
+	if _, ok := root["Mixed"].([]any); !ok {
+		t.Errorf("mixed: %#v", root["Mixed"])
+	}
+	if _, ok := root["Nils"].([]any); !ok {
+		t.Errorf("nils: %#v", root["Nils"])
+	}
+	if _, ok := root["Array"].(map[string]any); !ok {
+		t.Errorf("array: %#v", root["Array"])
+	}
+
+	y := new(lists)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+	if y.Array[0] != y.Array[1] || y.Array[0] != y.Mixed[1] {
+		t.Error("shared pointer was not preserved")
+	}
+}
+
+func TestReproducibleIndexes(t *testing.T) {
+	type graph struct {
+		ByName map[string]*event
+		ByID   map[int]*event
+		Order  []*event
+	}
+
+	build := func() *graph {
+		g := &graph{
+			ByName: make(map[string]*event),
+			ByID:   make(map[int]*event),
+		}
+
+		var prev *event
+		for i := range 20 {
+			e := &event{Seq: i, Next: prev}
+			g.ByName[strconv.Itoa(i*7%20)] = e
+			g.ByID[i*13%20] = e
+			prev = e
+		}
+		g.Order = []*event{prev, g.ByID[3]}
+		return g
+	}
+
+	hash := func(g *graph) [sha256.Size]byte {
+		objects, err := MarshalOptions(g, NewTypes(), Options{SortMapKeys: true})
+		if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+
+		data, err := json.Marshal(objects)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return sha256.Sum256(data)
+	}
+
+	h := hash(build())
+
+	for range 10 {
+		if hash(build()) != h {
+			t.Fatal("equal graphs produced different output")
+		}
+	}
+}
+
+func TestExplicitNull(t *testing.T) {
+	type patch struct {
+		Name  *string
+		Next  *event
+		Tags  []string
+		Count int
+	}
+
+	name := "name"
+
+	objects, err := MarshalOptions(&patch{Name: &name}, NewTypes(), Options{ExplicitNull: true})
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	root := objects[0].(map[string]any)
+	for _, key := range []string{"Next", "Tags"} {
+		if x, found := root[key]; !found || x != nil {
+			t.Errorf("%s: %#v %v", key, x, found)
+		}
+	}
+
+	objects, err = Marshal(&patch{Name: &name}, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if _, found := objects[0].(map[string]any)["Next"]; found {
+		t.Error("nil pointer marshaled without ExplicitNull")
+	}
+
+	// Explicit null resets, absent key leaves untouched.
+	sources := []any{map[string]any{"Next": nil, "Count": 2}}
+
+	y := &patch{Name: &name, Next: &event{}, Tags: []string{"tag"}}
+	if err := Unmarshal(sources, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(y, &patch{&name, nil, []string{"tag"}, 2}) {
+		t.Errorf("unmarshaled: %#v", y)
+	}
+}
+
+func TestCaptureReaders(t *testing.T) {
+	type request struct {
+		Body   io.Reader
+		Seeker io.ReadSeeker
+		Other  any
+	}
+
+	x := &request{
+		Body:   bytes.NewBufferString("hello, world"),
+		Seeker: bytes.NewReader([]byte{0, 1, 2}),
+		Other:  "not captured",
+	}
+
+	opts := Options{CaptureReaders: true}
+
+	objects, err := MarshalOptions(x, NewTypes(), opts)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	root := objects[0].(map[string]any)
+	if s := root["Body"]; s != base64.StdEncoding.EncodeToString([]byte("hello, world")) {
+		t.Errorf("body: %#v", s)
+	}
+	if n := x.Body.(*bytes.Buffer).Len(); n != 0 {
+		t.Error("buffer was not consumed:", n)
+	}
+
+	y := new(request)
+	if err := UnmarshalOptions(objects, y, NewTypes(), opts); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	if data, err := io.ReadAll(y.Body); err != nil || string(data) != "hello, world" {
+		t.Errorf("body: %q %v", data, err)
+	}
+	if data, err := io.ReadAll(y.Seeker); err != nil || !bytes.Equal(data, []byte{0, 1, 2}) {
+		t.Errorf("seeker: %q %v", data, err)
+	}
+	if y.Other != "not captured" {
+		t.Errorf("other: %#v", y.Other)
+	}
+
+	x.Body = strings.NewReader("too long")
+	opts.MaxBytes = 4
+
+	if _, err := MarshalOptions(x, NewTypes(), opts); err == nil {
+		t.Error("reader size limit was not enforced")
+	}
+}
+
+func TestMarshalAppend(t *testing.T) {
+	x := &event{1, &event{2, nil}}
+
+	prefix := []any{"prefix"}
+	objects, err := MarshalAppend(prefix, x, NewTypes(), Options{})
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if len(objects) != 3 || objects[0] != "prefix" {
+		t.Fatalf("objects: %#v", objects)
+	}
+
+	y := new(event)
+	if err := Unmarshal(objects[1:], y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+
+	buf := make([]any, 0, 10)
+	objects, err = MarshalAppend(buf, x, NewTypes(), Options{})
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if &objects[0] != &buf[:1][0] {
+		t.Error("buffer was not reused")
+	}
+}
+
+func BenchmarkMarshalAppend(b *testing.B) {
+	x := &event{Seq: 0}
+	for i := 1; i < 100; i++ {
+		x = &event{i, x}
+	}
+
+	b.Run("Fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			if _, err := MarshalOptions(x, NewTypes(), Options{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Reuse", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []any
+		for range b.N {
+			var err error
+			if buf, err = MarshalAppend(buf[:0], x, NewTypes(), Options{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkMarshalStructs(b *testing.B) {
+	type point struct {
+		X, Y  int
+		Label string `marshal:"label,omitempty"`
+	}
+
+	points := make([]point, 100000)
+	for i := range points {
+		points[i] = point{X: i, Y: -i}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		if _, err := Marshal(&points, NewTypes(), false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type greeterConfig struct {
+	Greeting string
+	Excited  bool
+}
+
+type greeter struct {
+	Config greeterConfig
+	Greet  func(name string) string `marshal:",via=Config"`
+}
+
+func newGreetFunc(c greeterConfig) func(string) string {
+	return func(name string) string {
+		s := c.Greeting + ", " + name
+		if c.Excited {
+			s += "!"
+		}
+		return s
+	}
+}
+
+func TestFuncFactory(t *testing.T) {
+	types := NewTypes()
+	if err := types.RegisterFuncFactory(newGreetFunc); err != nil {
+		t.Fatal(err)
+	}
+	if err := types.RegisterFuncFactory(newGreetFunc); err == nil {
+		t.Error("duplicate factory was registered")
+	}
+	if err := types.RegisterFuncFactory(func(int) int { return 0 }); err == nil {
+		t.Error("invalid factory was registered")
+	}
+	if err := types.RegisterFuncFactory(nil); err == nil {
+		t.Error("nil factory was registered")
+	}
+
+	config := greeterConfig{"Hello", true}
+	x := &greeter{config, newGreetFunc(config)}
+
+	objects, err := Marshal(x, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if _, found := objects[0].(map[string]any)["Greet"]; found {
+		t.Error("function field was marshaled")
+	}
+
+	y := new(greeter)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	if y.Config != config {
+		t.Errorf("config: %#v", y.Config)
+	}
+	if s := y.Greet("world"); s != "Hello, world!" {
+		t.Errorf("greeting: %q", s)
+	}
+
+	if err := Unmarshal(objects, new(greeter), NewTypes()); err == nil {
+		t.Error("unregistered factory did not cause an error")
+	}
+
+	type Settings struct {
+		Config greeterConfig
+	}
+	type embedded struct {
+		*Settings
+		Greet func(name string) string `marshal:",via=Config"`
+	}
+
+	e := new(embedded)
+	if err := Unmarshal([]any{map[string]any{}}, e, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if s := e.Greet("world"); s != ", world" {
+		t.Errorf("greeting: %q", s)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	type credentials struct {
+		User     string
+		Password string `marshal:",encrypt"`
+	}
+
+	xor := func(s string) string {
+		b := []byte(s)
+		for i := range b {
+			b[i] ^= 0x5a
+		}
+		return string(b)
+	}
+
+	var paths []string
+
+	opts := Options{
+		Transform: func(path, tag string, value any) (any, error) {
+			paths = append(paths, path+" "+tag)
+			return base64.StdEncoding.EncodeToString([]byte(xor(value.(string)))), nil
+		},
+		Untransform: func(path, tag string, value any) (any, error) {
+			b, err := base64.StdEncoding.DecodeString(value.(string))
+			return xor(string(b)), err
+		},
+	}
+
+	x := &credentials{"user", "secret"}
+
+	objects, err := MarshalOptions(x, NewTypes(), opts)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	root := objects[0].(map[string]any)
+	if root["User"] != "user" {
+		t.Errorf("user: %#v", root["User"])
+	}
+	if s := root["Password"]; s != base64.StdEncoding.EncodeToString([]byte(xor("secret"))) {
+		t.Errorf("password: %#v", s)
+	}
+	if !reflect.DeepEqual(paths, []string{".Password ,encrypt"}) {
+		t.Error("paths:", paths)
+	}
+
+	y := new(credentials)
+	if err := UnmarshalOptions(objects, y, NewTypes(), opts); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if *x != *y {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+
+	if _, err := Marshal(x, NewTypes(), false); err == nil {
+		t.Error("encrypted field was marshaled without transform")
+	}
+	if err := Unmarshal(objects, new(credentials), NewTypes()); err == nil {
+		t.Error("encrypted field was unmarshaled without untransform")
+	}
+
+	// Interned values must not leak the plaintext.
+	type shared struct {
+		Public string
+		Secret string `marshal:",encrypt"`
+	}
+	objects, err = MarshalOptions(&shared{"user", "hunter2"}, NewTypes(), Options{
+		InternValues: true,
+		Transform: func(path, tag string, value any) (any, error) {
+			if _, ok := value.(string); !ok {
+				return nil, errors.New("transformed value is not a string")
+			}
+			return "ENC", nil
+		},
+	})
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if data, _ := json.Marshal(objects); strings.Contains(string(data), "hunter2") {
+		t.Errorf("plaintext in output: %s", data)
+	}
+
+	type pointer struct {
+		P *string `marshal:",encrypt"`
+	}
+	secret := "topsecret"
+	if _, err := MarshalOptions(&pointer{&secret}, NewTypes(), opts); err == nil || !strings.Contains(err.Error(), "may contain pointers") {
+		t.Errorf("pointer field: %v", err)
+	}
+}
+
+func TestMarshalErrorPath(t *testing.T) {
+	type config struct {
+		Handlers map[string][]any
+	}
+
+	x := &config{
+		Handlers: map[string][]any{
+			"main": {1, func() {}},
+		},
+	}
+
+	_, err := Marshal(x, NewTypes(), false)
+	if err == nil || err.Error() != `marshal: at .Handlers["main"][1]: type not registered: func()` {
+		t.Error(err)
+	}
+}
+
+func TestInternValues(t *testing.T) {
+	type doc struct {
+		Title  string
+		Labels []string
+		Hash   []byte
+		Sum    [4]byte
+		Extra  any
+		Note   *string
+	}
+
+	note := "repeated"
+	x := &doc{
+		Title:  "repeated",
+		Labels: []string{"repeated", "other", "other"},
+		Hash:   []byte{1, 2, 3, 4},
+		Sum:    [4]byte{1, 2, 3, 4},
+		Extra:  "repeated",
+		Note:   &note,
+	}
+
+	opts := Options{InternValues: true}
+
+	objects, err := MarshalOptions(x, NewTypes(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := objects[0].(map[string]any)
+	labels := root["Labels"].([]any)
+	if root["Title"] != labels[0] || labels[1] != labels[2] || labels[0] == labels[1] {
+		t.Errorf("strings: %#v %#v", root["Title"], labels)
+	}
+	if index, ok := root["Title"].(int); !ok || objects[index] != "repeated" {
+		t.Errorf("title: %#v", root["Title"])
+	}
+	if root["Hash"] != root["Sum"] {
+		t.Errorf("bytes: %#v %#v", root["Hash"], root["Sum"])
+	}
+	if root["Extra"] != "repeated" {
+		t.Errorf("generic value was interned: %#v", root["Extra"])
+	}
+	if index := root["Note"].(int); objects[index] != "repeated" {
+		t.Errorf("pointer target: %#v", objects[index])
+	}
+
+	y := new(doc)
+	if err := UnmarshalOptions(objects, y, NewTypes(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+
+	opts.RequireAllReachable = true
+	if err := UnmarshalOptions(objects, new(doc), NewTypes(), opts); err != nil {
+		t.Error("interned objects were not reached:", err)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	type holder struct {
+		A shape
+		B shape
+		C any
+		D any
+	}
+
+	types := NewTypes().MustRegister(
+		Type("square", square{}),
+		Type("event", &event{}),
+		Type("unused", 0),
+	)
+
+	var manifest []string
+
+	x := &holder{A: square{1}, B: square{2}, C: &event{Seq: 3}, D: "untyped"}
+
+	if _, err := MarshalOptions(x, types, Options{Manifest: &manifest}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(manifest, []string{"event", "square"}) {
+		t.Error("manifest:", manifest)
+	}
+}
+
+func TestUnmarshalDispatch(t *testing.T) {
+	types := NewTypes().MustRegister(
+		TypeName(alt1{}),
+		Type("alt2ptr", &alt2{}),
+		Type("eventPtr", &event{}),
+	)
+
+	var (
+		names  []string
+		values []any
+	)
+
+	handle := func(name string, v any) error {
+		names = append(names, name)
+		values = append(values, v)
+		return nil
+	}
+
+	shared := &event{Seq: 3}
+	x := []any{alt1{"value"}, &alt2{"pointer"}, nil, shared, shared}
+
+	objects, err := Marshal(&x, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	if err := UnmarshalDispatch(objects, types, handle); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	if !reflect.DeepEqual(names, []string{"alt1", "alt2ptr", "eventPtr", "eventPtr"}) {
+		t.Error("names:", names)
+	}
+	if !reflect.DeepEqual(values, []any{alt1{"value"}, &alt2{"pointer"}, shared, shared}) {
+		t.Errorf("values: %#v", values)
+	}
+	if values[2] != values[3] {
+		t.Error("sharing was not preserved")
+	}
+
+	names, values = nil, nil
+
+	objects, err = MarshalEnvelope(alt1{"single"}, types, Options{})
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	if err := UnmarshalDispatch(objects, types, handle); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(names, []string{"alt1"}) || !reflect.DeepEqual(values, []any{alt1{"single"}}) {
+		t.Errorf("single: %v %#v", names, values)
+	}
+
+	stop := errors.New("stop")
+	if err := UnmarshalDispatch(objects, types, func(string, any) error { return stop }); err != stop {
+		t.Error("handler error:", err)
+	}
+}
+
+func TestTypedNil(t *testing.T) {
+	type holder struct {
+		Alt alt
+		Any any
+	}
+
+	types := NewTypes().MustRegister(Type("alt2ptr", &alt2{}))
+
+	x := &holder{Alt: (*alt2)(nil), Any: (*alt2)(nil)}
+
+	objects, err := Marshal(x, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	y := new(holder)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	for _, v := range []any{y.Alt, y.Any} {
+		if v == nil {
+			t.Error("nil interface")
+		} else if p, ok := v.(*alt2); !ok || p != nil {
+			t.Errorf("not a typed nil: %#v", v)
+		}
+	}
+}
+
+func TestTypedNilElements(t *testing.T) {
+	type holder struct {
+		Slice []alt
+		Map   map[string]alt
+	}
+
+	types := NewTypes().MustRegister(Type("alt2ptr", &alt2{}))
+
+	for _, opts := range []Options{{}, {HomogeneousInterfaceSlices: true}} {
+		x := &holder{
+			Slice: []alt{(*alt2)(nil), nil, &alt2{"x"}},
+			Map:   map[string]alt{"typed": (*alt2)(nil), "untyped": nil},
+		}
+		if opts.HomogeneousInterfaceSlices {
+			x.Slice = []alt{(*alt2)(nil), &alt2{"x"}}
+		}
+
+		objects, err := MarshalOptions(x, types, opts)
+		if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+
+		y := new(holder)
+		if err := UnmarshalOptions(objects, y, types, opts); err != nil {
+			t.Fatal("unmarshal error:", err)
+		}
+
+		for _, v := range []alt{y.Slice[0], y.Map["typed"]} {
+			if v == nil {
+				t.Errorf("%+v: nil interface", opts)
+			} else if p, ok := v.(*alt2); !ok || p != nil {
+				t.Errorf("%+v: not a typed nil: %#v", opts, v)
+			}
+		}
+		if v, found := y.Map["untyped"]; !found || v != nil {
+			t.Errorf("%+v: untyped: %#v %v", opts, v, found)
+		}
+		if p, ok := y.Slice[len(y.Slice)-1].(*alt2); !ok || p.Alt2 != "x" {
+			t.Errorf("%+v: last element: %#v", opts, y.Slice[len(y.Slice)-1])
+		}
+		if !opts.HomogeneousInterfaceSlices && y.Slice[1] != nil {
+			t.Errorf("not a nil interface: %#v", y.Slice[1])
+		}
+	}
+}
+
+type everyKind struct {
+	Bool       bool
+	Int        int
+	Int8       int8
+	Int16      int16
+	Int32      int32
+	Int64      int64
+	Uint       uint
+	Uint8      uint8
+	Uint16     uint16
+	Uint32     uint32
+	Uint64     uint64
+	Uintptr    uintptr
+	Float32    float32
+	Float64    float64
+	Complex64  complex64
+	Complex128 complex128
+	String     string
+	Array      [2]int16
+	Slice      []string
+	Struct     struct{ X, Y int }
+	Pointer    *int
+	Interface  any
+	Registered alt
+	IntMap     map[int]bool
+	Int8Map    map[int8]bool
+	Int16Map   map[int16]bool
+	Int32Map   map[int32]bool
+	Int64Map   map[int64]bool
+	UintMap    map[uint]bool
+	Uint8Map   map[uint8]bool
+	Uint16Map  map[uint16]bool
+	Uint32Map  map[uint32]bool
+	Uint64Map  map[uint64]bool
+	UintptrMap map[uintptr]bool
+	StringMap  map[string]bool
+	NamedMap   map[kindKey]kindValue
+}
+
+type (
+	kindKey   uint16
+	kindValue string
+)
+
+// TestEveryKind checks that marshaling and unmarshaling agree on all supported
+// kinds.
+func TestEveryKind(t *testing.T) {
+	types := NewTypes().MustRegister(TypeName(alt1{}))
+
+	n := 7
+	x := &everyKind{
+		Bool:       true,
+		Int:        -1,
+		Int8:       -2,
+		Int16:      -3,
+		Int32:      -4,
+		Int64:      -5,
+		Uint:       1,
+		Uint8:      2,
+		Uint16:     3,
+		Uint32:     4,
+		Uint64:     5,
+		Uintptr:    6,
+		Float32:    1.5,
+		Float64:    2.5,
+		Complex64:  1 + 2i,
+		Complex128: 3 + 4i,
+		String:     "string",
+		Array:      [2]int16{8, 9},
+		Slice:      []string{"a", "b"},
+		Struct:     struct{ X, Y int }{10, 11},
+		Pointer:    &n,
+		Interface:  map[string]any{"generic": []any{"value"}},
+		Registered: alt1{"alt"},
+		IntMap:     map[int]bool{-1: true},
+		Int8Map:    map[int8]bool{-2: true},
+		Int16Map:   map[int16]bool{-3: true},
+		Int32Map:   map[int32]bool{-4: true},
+		Int64Map:   map[int64]bool{-5: true},
+		UintMap:    map[uint]bool{1: true},
+		Uint8Map:   map[uint8]bool{2: true},
+		Uint16Map:  map[uint16]bool{3: true},
+		Uint32Map:  map[uint32]bool{4: true},
+		Uint64Map:  map[uint64]bool{5: true},
+		UintptrMap: map[uintptr]bool{6: true},
+		StringMap:  map[string]bool{"key": true},
+		NamedMap:   map[kindKey]kindValue{12: "named"},
+	}
+
+	objects, err := Marshal(x, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	y := new(everyKind)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+}
+
+type peerNode struct {
+	Name string
+	Peer any
+	Alt  alt
+}
+
+func (*peerNode) alt() {}
+
+func TestInterfaceCycle(t *testing.T) {
+	types := NewTypes().MustRegister(Type("peer", &peerNode{}))
+
+	a := &peerNode{Name: "a"}
+	b := &peerNode{Name: "b", Peer: a, Alt: a}
+	a.Peer = b
+	a.Alt = a
+
+	objects, err := Marshal(a, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	expect := []any{
+		map[string]any{"Name": "a", "Peer": map[string]any{"peer": 1}, "Alt": map[string]any{"peer": 0}},
+		map[string]any{"Name": "b", "Peer": map[string]any{"peer": 0}, "Alt": map[string]any{"peer": 0}},
+	}
+	if !reflect.DeepEqual(objects, expect) {
+		t.Errorf("objects: %#v", objects)
+	}
+
+	y := new(peerNode)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	peer := y.Peer.(*peerNode)
+	if y.Name != "a" || peer.Name != "b" {
+		t.Error("names:", y.Name, peer.Name)
+	}
+	if peer.Peer != any(y) || y.Alt != alt(y) || peer.Alt != alt(y) {
+		t.Error("identity was not preserved")
+	}
+}
+
+func TestRefCounts(t *testing.T) {
+	types := NewTypes().MustRegister(
+		TypeName(alt1{}),
+		Type("alt2ptr", &alt2{}),
+	)
+
+	var counts map[int]int
+
+	objects, err := MarshalOptions(newTopLevel(types), types, Options{
+		IgnoreUnsupportedTypes: true,
+		RefCounts:              &counts,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Self, Slice[0], StructEmbedded.Parent and StructIndirect.Parent refer
+	// to the root; the other objects are referenced once.
+	expect := map[int]int{0: 4}
+	for i := 1; i < len(objects); i++ {
+		expect[i] = 1
+	}
+	if !reflect.DeepEqual(counts, expect) {
+		t.Error("counts:", counts)
+	}
+}
+
+func TestOmitEmpty(t *testing.T) {
+	type record struct {
+		Count   int            `marshal:"count,omitempty"`
+		Total   int            `marshal:"total"`
+		Name    string         `marshal:",omitempty"`
+		Enabled bool           `marshal:",omitempty"`
+		Tags    []string       `marshal:",omitempty"`
+		Attrs   map[string]int `marshal:",omitempty"`
+		Array   [0]int         `marshal:",omitempty"`
+		Struct  struct{}       `marshal:",omitempty"`
+	}
+
+	objects, err := Marshal(&record{Tags: []string{}}, NewTypes(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]any{"total": 0, "Struct": map[string]any{}}
+	if !reflect.DeepEqual(objects[0], expect) {
+		t.Errorf("marshaled: %#v", objects[0])
+	}
+
+	x := &record{Count: 1, Total: 2, Name: "name", Enabled: true, Tags: []string{"tag"}, Attrs: map[string]int{"a": 3}}
+
+	objects, err = Marshal(x, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	y := new(record)
+	if err := Unmarshal(objects, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+}
+
+func TestMarshalValue(t *testing.T) {
+	tail := &event{Seq: 2}
+	x := event{1, tail}
+
+	objects, err := MarshalValue(x, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	expect := []any{
+		map[string]any{"Seq": 1, "Next": 1},
+		map[string]any{"Seq": 2},
+	}
+	if !reflect.DeepEqual(objects, expect) {
+		t.Errorf("objects: %#v", objects)
+	}
+
+	var y event
+	if err := Unmarshal(objects, &y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+
+	objects, err = MarshalValue([]*event{tail, tail}, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if !reflect.DeepEqual(objects[0], []any{1, 1}) {
+		t.Errorf("slice root: %#v", objects)
+	}
+}
+
+func TestMapAsEntries(t *testing.T) {
+	type record struct {
+		Names  map[int]string
+		Counts map[kindKey]int
+		Nested map[string]map[string]*event
+	}
+
+	shared := &event{Seq: 1}
+	x := &record{
+		Names:  map[int]string{3: "c", 1: "a", 2: "b"},
+		Counts: map[kindKey]int{20: 2, 10: 1},
+		Nested: map[string]map[string]*event{"x": {"b": shared, "a": shared, "nil": nil}},
+	}
+
+	opts := Options{MapAsEntries: true}
+
+	data, err := MarshalJSON(x, NewTypes(), opts)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	expect := `[{"Counts":[[10,1],[20,2]],"Names":[[1,"a"],[2,"b"],[3,"c"]],"Nested":[["x",[["a",1],["b",1],["nil",null]]]]},{"Seq":1}]`
+	if string(data) != expect {
+		t.Error("JSON:", string(data))
+	}
+
+	for range 10 {
+		again, err := MarshalJSON(x, NewTypes(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(again) != string(data) {
+			t.Fatal("output is not deterministic")
+		}
+	}
+
+	y := new(record)
+	if err := UnmarshalJSON(data, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+	if y.Nested["x"]["a"] != y.Nested["x"]["b"] {
+		t.Error("sharing was not preserved")
+	}
+}
+
+func TestMultiLevelPointers(t *testing.T) {
+	type counter struct {
+		N int
+	}
+
+	type indirect struct {
+		Top     *topLevel
+		TopPtr  **topLevel
+		Int     **int
+		Sub     **subLevel
+		Counter *counter
+		N       *int // Same address as Counter.
+	}
+
+	types := NewTypes()
+	if err := types.Register(
+		TypeName(alt1{}),
+		Type("alt2ptr", &alt2{}),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	top := newTopLevel(types)
+	n := 42
+	pn := &n
+	sub := &subLevel{Parent: top}
+	c := &counter{N: 7}
+
+	x := &indirect{
+		Top:     top,
+		TopPtr:  &top,
+		Int:     &pn,
+		Sub:     &sub,
+		Counter: c,
+		N:       &c.N,
+	}
+
+	objects, err := Marshal(x, types, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	y := new(indirect)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal(err)
+	}
+
+	if *y.TopPtr != y.Top {
+		t.Error("**topLevel does not share identity with *topLevel")
+	}
+	if **y.Int != 42 {
+		t.Error("**int:", **y.Int)
+	}
+	if (*y.Sub).Parent != y.Top {
+		t.Error("**subLevel parent does not share identity")
+	}
+	if y.Counter.N != 7 || *y.N != 7 {
+		t.Error("counter:", y.Counter.N, *y.N)
+	}
+	if y.Top.Self != y.Top || y.Top.StructIndirect.Parent != y.Top {
+		t.Error("topLevel self-references were not preserved")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	type config struct {
+		Handlers map[string][]any
+		Alt      alt
+	}
+	type secret struct {
+		Value string `marshal:",encrypt"`
+	}
+
+	types := NewTypes().MustRegister(TypeName(alt1{}))
+
+	for _, c := range []struct {
+		x    any
+		opts Options
+	}{
+		{&config{Alt: alt1{}}, Options{}},
+		{&config{Handlers: map[string][]any{"main": {1, func() {}}}}, Options{}},
+		{&config{Alt: &alt2{}}, Options{}},
+		{&secret{"x"}, Options{}},
+		{newTopLevel(types), Options{IgnoreUnsupportedTypes: true}},
+		{newTopLevel(types), Options{}},
+	} {
+		err := Validate(c.x, types, c.opts)
+		_, expect := MarshalOptions(c.x, types, c.opts)
+		if (err == nil) != (expect == nil) || err != nil && err.Error() != expect.Error() {
+			t.Errorf("validate: %v\nmarshal:  %v", err, expect)
+		}
+	}
+
+	opts := Options{
+		Transform: func(path, tag string, value any) (any, error) {
+			return nil, errors.New("transform was called")
+		},
+	}
+	if err := Validate(&secret{"x"}, types, opts); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	types := NewTypes().MustRegister(TypeName(alt1{}), Type("alt2ptr", &alt2{}))
+
+	for _, opts := range []Options{
+		{IgnoreUnsupportedTypes: true},
+		{IgnoreUnsupportedTypes: true, InternValues: true},
+	} {
+		objects, err := MarshalOptions(newTopLevel(types), types, opts)
+		if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+
+		count, size, err := EstimateSize(newTopLevel(types), types, opts)
+		if err != nil {
+			t.Fatal("estimate error:", err)
+		}
+		if count != len(objects) {
+			t.Errorf("estimated %d objects, marshaled %d", count, len(objects))
+		}
+		if size <= 0 {
+			t.Errorf("estimated size: %d", size)
+		}
+		t.Logf("%+v: %d objects, %d bytes", opts, count, size)
+	}
+
+	if _, _, err := EstimateSize(newTopLevel(types), types, Options{}); err == nil {
+		t.Error("unsupported types were not reported")
+	}
+}
+
+func TestIncludeUnexported(t *testing.T) {
+	type inner struct {
+		secret int
+	}
+	type account struct {
+		Name    string
+		balance int
+		history []int
+		inner   inner
+		next    *account
+	}
+
+	x := &account{Name: "a", balance: 10, history: []int{1, 2}, inner: inner{3}}
+	x.next = x
+
+	opts := Options{IncludeUnexported: true}
+
+	objects, err := MarshalOptions(x, NewTypes(), opts)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	y := new(account)
+	if err := UnmarshalOptions(objects, y, NewTypes(), opts); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !SharingEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+
+	z := new(account)
+	if err := Unmarshal(objects, z, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(z, &account{Name: "a"}) {
+		t.Errorf("unexported fields were unmarshaled without option: %#v", z)
+	}
+}
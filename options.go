@@ -0,0 +1,183 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import "reflect"
+
+type Options struct {
+	IgnoreUnsupportedTypes bool
+
+	// SnapshotChannels causes the buffered elements of bidirectional channels
+	// to be marshaled as slices.  The elements are received from the channel
+	// and sent back to it, so the operation is not atomic: concurrent senders
+	// or receivers may observe an empty channel, interleave with the snapshot,
+	// or cause elements to be lost if the channel fills up in the meantime.
+	// When unmarshaling, a new channel is created with capacity for the
+	// snapshotted elements.
+	SnapshotChannels bool
+
+	// SortMapKeys causes map entries to be marshaled in key order, so that
+	// object indexes are assigned deterministically.  Integer keys are
+	// ordered numerically and string keys lexically.
+	SortMapKeys bool
+
+	// UnwrapSingleImpl omits the type-name wrapper of an interface value if
+	// its dynamic type is the only registered type which implements the
+	// interface type.  Empty interfaces and nil pointers are not affected.
+	// The same option must be used when unmarshaling.
+	UnwrapSingleImpl bool
+
+	// RequireTree causes marshaling to fail if the same object is referenced
+	// by more than one pointer (including cycles).
+	RequireTree bool
+
+	// HomogeneousInterfaceSlices causes interface slices and arrays whose
+	// elements all have the same registered type to be marshaled with a single
+	// type-name wrapper around the bare element values.  Unmarshaling detects
+	// the form automatically.
+	HomogeneousInterfaceSlices bool
+
+	// ExplicitNull causes struct fields with nil pointers, maps, slices and
+	// interfaces to be marshaled as explicit nil entries instead of being
+	// omitted.  Unmarshaling resets a field to its zero value if its entry is
+	// nil, whereas fields without an entry are left untouched.
+	ExplicitNull bool
+
+	// CaptureReaders causes interface values of io.Reader-based types (which
+	// *bytes.Reader implements, such as io.Reader and io.ReadSeeker) to be
+	// marshaled as base64-encoded strings of their contents.  The reader is
+	// consumed: after marshaling it is at EOF.  When unmarshaling, such
+	// values are reconstructed as *bytes.Reader instances.
+	CaptureReaders bool
+
+	// MaxBytes limits the amount of data captured from a single reader when
+	// CaptureReaders is enabled.  Marshaling fails if a reader has more data.
+	// Zero means no limit.  It doesn't limit the size of the output; see
+	// MaxOutputBytes.
+	MaxBytes int64
+
+	// MaxOutputBytes limits the size of the JSON encoding of a single value
+	// written by Encoder.  Encoding stops with ErrBudgetExceeded before the
+	// first write which would exceed the limit, so the stream is left with a
+	// truncated prefix.  Zero means no limit.  Other functions ignore it.
+	MaxOutputBytes int64
+
+	// RequireAllReachable causes unmarshaling to fail if some objects of the
+	// list are not reachable from the root object.
+	RequireAllReachable bool
+
+	// Transform is applied to the marshaled values of struct fields tagged
+	// with the encrypt option, and Untransform to their source values before
+	// unmarshaling.  The path locates the field within the root object (e.g.
+	// ".Users[3].Password") and the tag is its struct tag value.  Marshaling
+	// and unmarshaling of such fields fail if the corresponding function is
+	// not set.
+	Transform   func(path, tag string, value any) (any, error)
+	Untransform func(path, tag string, value any) (any, error)
+
+	// Manifest is set to the sorted names of the registered types and codecs
+	// which were written to the output.
+	Manifest *[]string
+
+	// ScalarConverters are used when unmarshaling a scalar value of a
+	// different kind than the destination.  The converter for the
+	// destination kind returns a value of that kind, or false if the value
+	// cannot be converted.  Converters are not used for numbers which can be
+	// coerced to a numeric destination.
+	ScalarConverters map[reflect.Kind]func(any) (any, bool)
+
+	// RefCounts is set to the number of pointers referring to each object
+	// index.  The root pointer is not counted.
+	RefCounts *map[int]int
+
+	// OnMarshaled is called with the complete object list before it is
+	// returned.  Returning an error causes marshaling to fail with it.
+	OnMarshaled func(objects []any) error
+
+	// MapAsEntries causes maps to be marshaled as lists of [key, value]
+	// pairs, sorted by key.  Unmarshaling accepts both representations.
+	MapAsEntries bool
+
+	// RawUnknownTypes causes single-entry maps with string keys to be
+	// unmarshaled as RawType values when they are decoded into empty
+	// interfaces and the key is not a registered type name.  (Without this
+	// option they are decoded as generic maps.)  Values of unknown types
+	// cannot be decoded into non-empty interfaces.
+	RawUnknownTypes bool
+
+	// MaxDepth limits the nesting of values, including values reached via
+	// pointers, when marshaling and unmarshaling.  Zero means unlimited.
+	MaxDepth int
+
+	// TagKey is the struct tag key used for field options.  The default is
+	// "marshal".
+	TagKey string
+
+	// InternValues causes equal strings and byte slices or arrays to be
+	// stored only once in the object list; they are referenced by index like
+	// pointers.  Values held by empty interfaces and pointers are not
+	// interned.  The same option must be used when unmarshaling.
+	InternValues bool
+
+	// StructMapKeys allows maps with struct-typed keys.  Each key is
+	// marshaled and encoded as a JSON string, with fields in sorted order.
+	// Key types must not contain pointers or interfaces, and keys which
+	// differ only in fields which are not marshaled are an error.  The same
+	// option must be used when unmarshaling.
+	StructMapKeys bool
+
+	// ExplicitWrappers causes interface values to be wrapped in maps of the
+	// form {"$type": name, "$value": value} instead of {name: value}.  When
+	// unmarshaling with this option, single-entry maps are not mistaken for
+	// type-name wrappers.  Explicit wrappers are recognized regardless of the
+	// option, so a generic map with a "$type" entry cannot be unmarshaled
+	// into an empty interface.
+	ExplicitWrappers bool
+
+	// Merge causes unmarshaling to update existing maps and slices instead of
+	// replacing them.  Map entries which are not in the source are preserved.
+	// Existing map values and slice elements are decoded over, so struct
+	// fields which are missing from the source keep their values.  Slices are
+	// resized to the source length.
+	Merge bool
+
+	// ComplexPairs causes complex numbers to be marshaled as [real, imag]
+	// slices, which can be encoded as JSON.  Unmarshaling accepts both
+	// representations.
+	ComplexPairs bool
+
+	// PadShortArrays allows unmarshaling arrays from shorter sources; the
+	// remaining elements are zeroed.  TruncateLongArrays allows unmarshaling
+	// arrays from longer sources; the extra elements are ignored.  Without
+	// these options the lengths must match.
+	PadShortArrays     bool
+	TruncateLongArrays bool
+
+	// IncludeUnexported causes the unexported fields of all struct types to
+	// be marshaled and unmarshaled, like Types.AllowUnexported does for
+	// specific types.  The fields are accessed using package unsafe, which
+	// bypasses the encapsulation of other packages: their invariants may be
+	// broken by unmarshaling, and internal state such as caches, file
+	// descriptors or pointers into foreign memory is copied verbatim.
+	// Non-addressable struct values are copied before their fields are read.
+	IncludeUnexported bool
+
+	// DisallowUnknownFields causes unmarshaling to fail if a struct's source
+	// map has an entry which doesn't correspond to a field of the struct.
+	DisallowUnknownFields bool
+
+	// MaxObjects limits the length of the object list when unmarshaling.
+	// Objects are allocated only for list entries, so this also limits the
+	// number of pointer targets.  It should be set when decoding untrusted
+	// data.  Zero means unlimited.
+	MaxObjects int
+}
+
+// resolve fills in default values.
+func (opts Options) resolve() Options {
+	if opts.TagKey == "" {
+		opts.TagKey = defaultTagKey
+	}
+	return opts
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// path tracks the location of the value being processed.  Elements are pushed
+// and popped without defer, so the path of a failed value is left in place
+// when a panic unwinds the stack.
+type path []pathElem
+
+type pathElem struct {
+	field string        // Struct field name, if not empty.
+	key   reflect.Value // Map key, if valid.
+	index int           // Slice or array index.
+}
+
+func (p *path) pushField(name string)     { *p = append(*p, pathElem{field: name}) }
+func (p *path) pushKey(key reflect.Value) { *p = append(*p, pathElem{key: key}) }
+func (p *path) pushIndex(i int)           { *p = append(*p, pathElem{index: i}) }
+func (p *path) pop()                      { *p = (*p)[:len(*p)-1] }
+
+func (p path) String() string {
+	var b strings.Builder
+
+	for _, e := range p {
+		switch {
+		case e.field != "":
+			b.WriteString(".")
+			b.WriteString(e.field)
+
+		case e.key.IsValid():
+			if e.key.Kind() == reflect.String {
+				fmt.Fprintf(&b, "[%q]", e.key.String())
+			} else {
+				fmt.Fprintf(&b, "[%v]", e.key)
+			}
+
+		default:
+			fmt.Fprintf(&b, "[%d]", e.index)
+		}
+	}
+
+	return b.String()
+}
+
+// wrap err with the path, if any.  The prefix is "marshal: " or "unmarshal: ".
+func (p path) wrap(prefix string, err error) error {
+	if len(p) == 0 {
+		return err
+	}
+	return &pathError{prefix, p.String(), err}
+}
+
+type pathError struct {
+	prefix string
+	path   string
+	err    error
+}
+
+func (e *pathError) Error() string {
+	return e.prefix + "at " + e.path + ": " + strings.TrimPrefix(e.err.Error(), e.prefix)
+}
+
+func (e *pathError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+var (
+	readerType      = reflect.TypeFor[io.Reader]()
+	bytesReaderType = reflect.TypeFor[*bytes.Reader]()
+)
+
+// isCapturedReaderType checks if interface values of type t are captured when
+// the CaptureReaders option is enabled.
+func isCapturedReaderType(t reflect.Type) bool {
+	return t.Kind() == reflect.Interface && t.Implements(readerType) && bytesReaderType.Implements(t)
+}
+
+// captureReader reads r until EOF and encodes the data as base64.
+func captureReader(r io.Reader, maxBytes int64) (string, error) {
+	if maxBytes > 0 {
+		r = io.LimitReader(r, maxBytes+1)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	if maxBytes > 0 && int64(len(data)) > maxBytes {
+		return "", fmt.Errorf("reader contents exceed %d bytes", maxBytes)
+	}
+
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func restoreReader(s string) (*bytes.Reader, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"reflect"
+)
+
+// ExportSchema describes the shapes of the registered types and codec
+// representations, keyed by registered name.  The description consists of
+// maps, slices and strings, so it can be encoded as JSON.
+//
+// Each type is described by a map with a "kind" entry (reflect.Kind name).
+// Named types (other than predeclared ones) have a "type" entry.  References
+// to other registered types have a "name" entry instead of a full
+// description.  Pointer, slice and array types have an "elem" entry, and
+// arrays also "len".  Maps have "key" and "elem" entries.  Structs have a
+// "fields" list with "name" and "type" entries, and "required" if the field is
+// required.  Codecs are described by the kind "codec" and their "repr" type.
+// Types which implement Marshaler are described by the kind "marshaler", and
+// types which implement encoding.TextMarshaler by the kind "string" with the
+// "encoding" "text".  Byte slices and arrays are described by the kind
+// "string" with the "encoding" "base64".
+func (ts *Types) ExportSchema() (map[string]any, error) {
+	if err := ts.resolveLazy(); err != nil {
+		return nil, err
+	}
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	schema := make(map[string]any, len(ts.nameTypes)+len(ts.codecs))
+
+	for name, t := range ts.nameTypes {
+		d, err := ts.describe(t, true, make(map[reflect.Type]bool))
+		if err != nil {
+			return nil, err
+		}
+		schema[name] = d
+	}
+
+	for _, c := range ts.codecs {
+		d, err := ts.describe(c.repr, false, make(map[reflect.Type]bool))
+		if err != nil {
+			return nil, err
+		}
+		schema[c.name] = map[string]any{
+			"kind": "codec",
+			"repr": d,
+		}
+	}
+
+	return schema, nil
+}
+
+// describe a type.  Registered types are referenced by name unless top is
+// set.  Structs which are already being described are not expanded again.  The
+// lock must be held.
+func (ts *Types) describe(t reflect.Type, top bool, seen map[reflect.Type]bool) (map[string]any, error) {
+	if !top {
+		if name, found := ts.typeNames[t]; found {
+			return map[string]any{"name": name}, nil
+		}
+	}
+
+	d := map[string]any{"kind": t.Kind().String()}
+	if t.PkgPath() != "" {
+		d["type"] = t.String()
+	}
+
+	switch t.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		// Hooks are invoked for the referenced value.
+	default:
+		if implements(t, marshalerType) {
+			d["kind"] = "marshaler"
+			return d, nil
+		}
+		if implements(t, textMarshalerType) {
+			d["kind"] = reflect.String.String()
+			d["encoding"] = "text"
+			return d, nil
+		}
+		if (t.Kind() == reflect.Array || t.Kind() == reflect.Slice) && t.Elem().Kind() == reflect.Uint8 {
+			d["kind"] = reflect.String.String()
+			d["encoding"] = "base64"
+			return d, nil
+		}
+	}
+
+	var err error
+
+	switch t.Kind() {
+	case reflect.Array:
+		d["len"] = t.Len()
+		fallthrough
+
+	case reflect.Pointer, reflect.Slice:
+		d["elem"], err = ts.describe(t.Elem(), false, seen)
+
+	case reflect.Map:
+		if d["key"], err = ts.describe(t.Key(), false, seen); err == nil {
+			d["elem"], err = ts.describe(t.Elem(), false, seen)
+		}
+
+	case reflect.Struct:
+		if seen[t] {
+			break
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		var fields []field
+		if fields, err = structFields(t, defaultTagKey); err != nil {
+			return nil, err
+		}
+
+		unexported := ts.unexported[t]
+		list := make([]any, 0, len(fields))
+
+		for _, f := range fields {
+			if (!f.IsExported() && !unexported) || f.via != "" {
+				continue
+			}
+
+			fd, err := ts.describe(f.Type, false, seen)
+			if err != nil {
+				return nil, err
+			}
+
+			entry := map[string]any{
+				"name": f.name,
+				"type": fd,
+			}
+			if f.required {
+				entry["required"] = true
+			}
+			list = append(list, entry)
+		}
+
+		d["fields"] = list
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// implements checks if t or *t implements iface.
+func implements(t, iface reflect.Type) bool {
+	return t.Implements(iface) || reflect.PointerTo(t).Implements(iface)
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportSchema(t *testing.T) {
+	type order struct {
+		ID    uint64 `marshal:",required"`
+		Items []alt1
+		Notes map[string]*event
+		Next  *event
+		Any   any
+		When  time.Time
+		Ver   version
+		Data  []byte
+	}
+
+	types := NewTypes().MustRegister(
+		TypeName(alt1{}),
+		Type("event", &event{}),
+		Type("order", order{}),
+	)
+
+	schema, err := types.ExportSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := json.Marshal(schema); err != nil {
+		t.Error(err)
+	}
+
+	expect := map[string]any{
+		"alt1": map[string]any{
+			"kind": "struct",
+			"type": "marshal.alt1",
+			"fields": []any{
+				map[string]any{"name": "Alt1", "type": map[string]any{"kind": "string"}},
+			},
+		},
+		"event": map[string]any{
+			"kind": "ptr",
+			"elem": map[string]any{
+				"kind": "struct",
+				"type": "marshal.event",
+				"fields": []any{
+					map[string]any{"name": "Seq", "type": map[string]any{"kind": "int"}},
+					map[string]any{"name": "Next", "type": map[string]any{"name": "event"}},
+				},
+			},
+		},
+		"order": map[string]any{
+			"kind": "struct",
+			"type": "marshal.order",
+			"fields": []any{
+				map[string]any{"name": "ID", "type": map[string]any{"kind": "uint64"}, "required": true},
+				map[string]any{"name": "Items", "type": map[string]any{
+					"kind": "slice",
+					"elem": map[string]any{"name": "alt1"},
+				}},
+				map[string]any{"name": "Notes", "type": map[string]any{
+					"kind": "map",
+					"key":  map[string]any{"kind": "string"},
+					"elem": map[string]any{"name": "event"},
+				}},
+				map[string]any{"name": "Next", "type": map[string]any{"name": "event"}},
+				map[string]any{"name": "Any", "type": map[string]any{"kind": "interface"}},
+				map[string]any{"name": "When", "type": map[string]any{"kind": "string", "encoding": "text", "type": "time.Time"}},
+				map[string]any{"name": "Ver", "type": map[string]any{"kind": "marshaler", "type": "marshal.version"}},
+				map[string]any{"name": "Data", "type": map[string]any{"kind": "string", "encoding": "base64"}},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(schema, expect) {
+		t.Errorf("schema: %#v", schema)
+	}
+}
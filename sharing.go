@@ -0,0 +1,127 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// SharingEqual is like reflect.DeepEqual, but it also requires that the
+// pointers of the two object graphs are shared in the same way: each pointer
+// in a must correspond to exactly one pointer in b and vice versa.  Cyclic
+// graphs are supported.  It can be used to check that a graph was
+// reconstructed faithfully.
+func SharingEqual(a, b any) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	s := sharing{
+		forward:  make(map[unsafe.Pointer]unsafe.Pointer),
+		backward: make(map[unsafe.Pointer]unsafe.Pointer),
+	}
+	return s.equal(reflect.ValueOf(a), reflect.ValueOf(b))
+}
+
+type sharing struct {
+	forward  map[unsafe.Pointer]unsafe.Pointer
+	backward map[unsafe.Pointer]unsafe.Pointer
+}
+
+func (s *sharing) equal(a, b reflect.Value) bool {
+	if a.Type() != b.Type() {
+		return false
+	}
+
+	switch a.Kind() {
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() == b.Uint()
+
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+
+	case reflect.Complex64, reflect.Complex128:
+		return a.Complex() == b.Complex()
+
+	case reflect.String:
+		return a.String() == b.String()
+
+	case reflect.Struct:
+		for i := range a.NumField() {
+			if !s.equal(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+
+	case reflect.Array:
+		for i := range a.Len() {
+			if !s.equal(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+
+	case reflect.Slice:
+		if a.IsNil() != b.IsNil() || a.Len() != b.Len() {
+			return false
+		}
+		for i := range a.Len() {
+			if !s.equal(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+
+	case reflect.Map:
+		if a.IsNil() != b.IsNil() || a.Len() != b.Len() {
+			return false
+		}
+		for iter := a.MapRange(); iter.Next(); {
+			v := b.MapIndex(iter.Key())
+			if !v.IsValid() || !s.equal(iter.Value(), v) {
+				return false
+			}
+		}
+		return true
+
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return s.equal(a.Elem(), b.Elem())
+
+	case reflect.Pointer:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+
+		pa := a.UnsafePointer()
+		pb := b.UnsafePointer()
+
+		if p, found := s.forward[pa]; found {
+			return p == pb
+		}
+		if _, found := s.backward[pb]; found {
+			return false
+		}
+		s.forward[pa] = pb
+		s.backward[pb] = pa
+
+		return s.equal(a.Elem(), b.Elem())
+
+	case reflect.Func:
+		return a.IsNil() && b.IsNil()
+
+	default: // Chan, UnsafePointer
+		return a.UnsafePointer() == b.UnsafePointer()
+	}
+}
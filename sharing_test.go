@@ -0,0 +1,60 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"testing"
+)
+
+func TestSharingEqual(t *testing.T) {
+	type pair struct {
+		A, B *event
+	}
+
+	shared := &event{Seq: 1}
+	a := &pair{shared, shared}
+	b := &pair{&event{Seq: 1}, &event{Seq: 1}}
+
+	if !SharingEqual(a, a) {
+		t.Error("graph is not equal to itself")
+	}
+	if SharingEqual(a, b) || SharingEqual(b, a) {
+		t.Error("graphs with different sharing are equal")
+	}
+
+	cycle1 := &event{Seq: 2}
+	cycle1.Next = cycle1
+	cycle2 := &event{Seq: 2}
+	cycle2.Next = cycle2
+	chain := &event{Seq: 2, Next: cycle2}
+
+	if !SharingEqual(cycle1, cycle2) {
+		t.Error("equal cycles are not equal")
+	}
+	if SharingEqual(cycle1, chain) {
+		t.Error("cycle is equal to chain")
+	}
+
+	types := NewTypes().MustRegister(
+		TypeName(alt1{}),
+		Type("alt2ptr", &alt2{}),
+	)
+
+	objects, err := Marshal(newTopLevel(types), types, true)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	x := new(topLevel)
+	y := new(topLevel)
+	if err := Unmarshal(objects, x, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !SharingEqual(x, y) {
+		t.Error("reconstructed graphs are not equal")
+	}
+}
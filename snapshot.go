@@ -0,0 +1,140 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+
+	"import.name/pan"
+)
+
+// Snapshotter marshals successive states of a mutable object graph.  Each
+// snapshot yields a delta which contains only the objects which are new or
+// have changed since the previous snapshot; unchanged objects keep their
+// indexes.  The complete object list is obtained by applying the deltas in
+// order using ApplyDelta.
+//
+// Objects which become unreachable are retained in the object list, and the
+// Snapshotter keeps them alive in memory.  With Options.InternValues, interned
+// strings keep their indexes across snapshots.
+type Snapshotter struct {
+	types    *Types
+	opts     Options
+	refs     map[ref]int
+	interned map[string]int
+	objects  []any
+}
+
+func NewSnapshotter(types *Types, opts Options) *Snapshotter {
+	return &Snapshotter{
+		types: types,
+		opts:  opts,
+		refs:  make(map[ref]int),
+	}
+}
+
+// Snapshot marshals the graph reachable from root, which must be a non-nil
+// pointer.  The delta consists of [index, object] pairs.  Unmarshal decodes
+// the object at index 0, so the root should remain the same object across
+// snapshots.
+func (s *Snapshotter) Snapshot(root any) (delta []any, rootIndex int, err error) {
+	v := reflect.ValueOf(root)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return nil, 0, errors.New("marshal: snapshot root must be a non-nil pointer")
+	}
+
+	m := newMarshaler(s.types, s.opts)
+	m.base = s.refs
+	m.interned = maps.Clone(s.interned)
+	m.objects = make([]any, len(s.objects))
+
+	if err := pan.Recover(func() {
+		x, ok := m.marshal(v, false)
+		if !ok {
+			pan.Panic(fmt.Errorf("marshal: %w", &UnsupportedTypeError{v.Type()}))
+		}
+		rootIndex = x.(int)
+	}); err != nil {
+		return nil, 0, m.path.wrap("marshal: ", err)
+	}
+
+	s.interned = m.interned
+
+	visited := make([]bool, len(m.objects))
+	for ptr, index := range m.refs {
+		visited[index] = true
+		s.refs[ptr] = index
+	}
+
+	for index, x := range m.objects {
+		if index < len(s.objects) {
+			if !visited[index] {
+				continue
+			}
+			if reflect.DeepEqual(s.objects[index], x) {
+				continue
+			}
+			s.objects[index] = x
+		} else {
+			s.objects = append(s.objects, x)
+		}
+
+		delta = append(delta, []any{index, x})
+	}
+
+	return delta, rootIndex, nil
+}
+
+// ApplyDelta updates an object list with a delta produced by
+// Snapshotter.Snapshot.  The updated object list is returned.  New objects
+// must be appended in index order: an index may not exceed the length of the
+// list.
+func ApplyDelta(objects []any, delta []any) ([]any, error) {
+	indexes := make([]int, len(delta))
+	n := len(objects)
+
+	for i, entry := range delta {
+		pair, ok := entry.([]any)
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("unmarshal: invalid delta entry: %v", entry)
+		}
+
+		var index int
+
+		switch i := pair[0].(type) {
+		case int:
+			index = i
+		case float64:
+			index = int(i)
+			if float64(index) != i {
+				index = -1
+			}
+		default:
+			index = -1
+		}
+
+		if index < 0 {
+			return nil, fmt.Errorf("unmarshal: invalid delta index: %v", pair[0])
+		}
+		if index > n {
+			return nil, fmt.Errorf("unmarshal: %w", &IndexError{index, n})
+		}
+		if index == n {
+			n++
+		}
+		indexes[i] = index
+	}
+
+	objects = slices.Grow(objects, n-len(objects))[:n]
+
+	for i, entry := range delta {
+		objects[indexes[i]] = entry.([]any)[1]
+	}
+
+	return objects, nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"reflect"
+	"testing"
+)
+
+type event struct {
+	Seq  int
+	Next *event
+}
+
+type eventLog struct {
+	Name  string
+	First *event
+	Last  *event
+}
+
+func TestSnapshotter(t *testing.T) {
+	s := NewSnapshotter(NewTypes(), Options{})
+	var objects []any
+
+	snapshot := func(x *eventLog) []any {
+		t.Helper()
+
+		delta, rootIndex, err := s.Snapshot(x)
+		if err != nil {
+			t.Fatal("snapshot error:", err)
+		}
+		if rootIndex != 0 {
+			t.Error("root index:", rootIndex)
+		}
+
+		objects, err = ApplyDelta(objects, delta)
+		if err != nil {
+			t.Fatal("apply error:", err)
+		}
+
+		var y eventLog
+		if err := Unmarshal(objects, &y, NewTypes()); err != nil {
+			t.Fatal("unmarshal error:", err)
+		}
+		if !reflect.DeepEqual(x, &y) {
+			t.Errorf("mismatch:\nx: %#v\ny: %#v", x, &y)
+		}
+
+		return delta
+	}
+
+	first := &event{Seq: 1}
+	x := &eventLog{"log", first, first}
+
+	if n := len(snapshot(x)); n != 2 {
+		t.Error("initial delta length:", n)
+	}
+
+	if n := len(snapshot(x)); n != 0 {
+		t.Error("unchanged delta length:", n)
+	}
+
+	second := &event{Seq: 2}
+	first.Next = second
+	x.Last = second
+
+	// Root, the first event and the new second event.
+	if n := len(snapshot(x)); n != 3 {
+		t.Error("append delta length:", n)
+	}
+
+	second.Seq = 20
+
+	if delta := snapshot(x); len(delta) != 1 || delta[0].([]any)[0] != 2 {
+		t.Error("modification delta:", delta)
+	}
+
+	x.Name = "renamed"
+
+	if delta := snapshot(x); len(delta) != 1 || delta[0].([]any)[0] != 0 {
+		t.Error("root delta:", delta)
+	}
+}
+
+func TestSnapshotInternValues(t *testing.T) {
+	opts := Options{InternValues: true}
+	s := NewSnapshotter(NewTypes(), opts)
+	x := &eventLog{Name: "hello"}
+
+	var objects []any
+
+	for i := range 3 {
+		delta, _, err := s.Snapshot(x)
+		if err != nil {
+			t.Fatal("snapshot error:", err)
+		}
+		if i > 0 && len(delta) != 0 {
+			t.Errorf("delta of unchanged graph: %v", delta)
+		}
+
+		objects, err = ApplyDelta(objects, delta)
+		if err != nil {
+			t.Fatal("apply error:", err)
+		}
+	}
+
+	if len(objects) != 2 {
+		t.Errorf("objects: %v", objects)
+	}
+
+	y := new(eventLog)
+	if err := UnmarshalOptions(objects, y, NewTypes(), opts); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if y.Name != "hello" {
+		t.Errorf("name: %q", y.Name)
+	}
+}
+
+func TestApplyDeltaInvalid(t *testing.T) {
+	for _, delta := range [][]any{
+		{1},
+		{[]any{1}},
+		{[]any{-1, nil}},
+		{[]any{1.5, nil}},
+		{[]any{-1.0, nil}},
+		{[]any{"1", nil}},
+		{[]any{1, nil}},
+		{[]any{float64(1 << 40), "x"}},
+		{[]any{0, nil}, []any{2, nil}},
+	} {
+		if _, err := ApplyDelta(nil, delta); err == nil {
+			t.Errorf("delta %v accepted", delta)
+		}
+	}
+
+	objects, err := ApplyDelta([]any{"a"}, []any{[]any{1, "b"}, []any{0, "c"}, []any{2, "d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(objects, []any{"c", "b", "d"}) {
+		t.Errorf("objects: %v", objects)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"import.name/pan"
+)
+
+var syncMapType = reflect.TypeFor[sync.Map]()
+
+// syncMapEntries copies the entries of a sync.Map into a map with values of
+// type any.  All keys must have the same type; an empty sync.Map yields a
+// map with string keys.  The sync.Map must not be modified concurrently.
+func syncMapEntries(v reflect.Value) (reflect.Value, error) {
+	if !v.CanAddr() {
+		tmp := reflect.New(v.Type()).Elem()
+		tmp.Set(v)
+		v = tmp
+	}
+	sm := v.Addr().Interface().(*sync.Map)
+
+	keyType := reflect.TypeFor[string]()
+	var keys, values []reflect.Value
+	var err error
+
+	sm.Range(func(key, value any) bool {
+		k := reflect.ValueOf(key)
+		if len(keys) == 0 {
+			keyType = k.Type()
+		} else if k.Type() != keyType {
+			err = fmt.Errorf("sync.Map has keys of different types: %s and %s", keyType, k.Type())
+			return false
+		}
+		keys = append(keys, k)
+		values = append(values, reflect.ValueOf(&value).Elem())
+		return true
+	})
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	r := reflect.MakeMapWithSize(reflect.MapOf(keyType, reflect.TypeFor[any]()), len(keys))
+	for i, k := range keys {
+		r.SetMapIndex(k, values[i])
+	}
+	return r, nil
+}
+
+// unmarshalSyncMap decodes a map or map entries into a sync.Map.  The keys
+// are stored with the types of the source keys (any in the case of entries).
+// Existing entries are removed unless the Merge option is set.
+func (u *unmarshaler) unmarshalSyncMap(src, dest reflect.Value) {
+	keyType := reflect.TypeFor[any]()
+	switch src.Kind() {
+	case reflect.Map:
+		keyType = src.Type().Key()
+	case reflect.Slice:
+	default:
+		pan.Panic(fmt.Errorf("unmarshal: expected map for %s, got %s", dest.Type(), src.Kind()))
+	}
+
+	tmp := reflect.New(reflect.MapOf(keyType, reflect.TypeFor[any]())).Elem()
+	u.unmarshal(src, tmp)
+
+	sm := dest.Addr().Interface().(*sync.Map)
+	if !u.opts.Merge {
+		sm.Range(func(key, _ any) bool {
+			sm.Delete(key)
+			return true
+		})
+	}
+
+	for iter := tmp.MapRange(); iter.Next(); {
+		sm.Store(iter.Key().Interface(), iter.Value().Interface())
+	}
+}
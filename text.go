@@ -0,0 +1,80 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+
+	"import.name/pan"
+)
+
+var (
+	textMarshalerType   = reflect.TypeFor[encoding.TextMarshaler]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// marshalText returns the text form of v if it implements
+// encoding.TextMarshaler.  For example, time.Time is represented in RFC 3339
+// format with nanoseconds, without the monotonic clock reading.
+func marshalText(v reflect.Value) (string, bool) {
+	x, ok := hook(v, textMarshalerType).(encoding.TextMarshaler)
+	if !ok {
+		return "", false
+	}
+
+	b, err := x.MarshalText()
+	if err != nil {
+		pan.Panic(fmt.Errorf("marshal: %s: %w", v.Type(), err))
+	}
+	return string(b), true
+}
+
+// unmarshalText decodes s into dest if it implements
+// encoding.TextUnmarshaler.
+func unmarshalText(s string, dest reflect.Value) bool {
+	switch dest.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		return false
+	}
+
+	x, ok := hook(dest, textUnmarshalerType).(encoding.TextUnmarshaler)
+	if !ok {
+		return false
+	}
+
+	if err := x.UnmarshalText([]byte(s)); err != nil {
+		pan.Panic(fmt.Errorf("unmarshal: %s: %w", dest.Type(), err))
+	}
+	return true
+}
+
+// isTextKeyType checks if map keys of type t are represented by their text
+// form.  Integer and string keys are represented as is.
+func isTextKeyType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr, reflect.String, reflect.Interface, reflect.Pointer:
+		return false
+	}
+
+	return t.Implements(textMarshalerType) && reflect.PointerTo(t).Implements(textUnmarshalerType)
+}
+
+// marshalTextKeys returns map keys and their text forms, sorted by text.
+func marshalTextKeys(keys []reflect.Value) ([]reflect.Value, []reflect.Value) {
+	texts := make([]string, len(keys))
+	for i, key := range keys {
+		texts[i], _ = marshalText(key)
+	}
+	return sortKeyTexts(keys, texts)
+}
+
+// unmarshalTextKey decodes a map key of a type for which isTextKeyType is
+// true.
+func unmarshalTextKey(s string, t reflect.Type) reflect.Value {
+	key := reflect.New(t).Elem()
+	unmarshalText(s, key)
+	return key
+}
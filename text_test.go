@@ -0,0 +1,196 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type color struct {
+	R, G, B uint8
+}
+
+func (c color) MarshalText() ([]byte, error) {
+	return fmt.Appendf(nil, "#%02x%02x%02x", c.R, c.G, c.B), nil
+}
+
+func (c *color) UnmarshalText(b []byte) error {
+	_, err := fmt.Sscanf(string(b), "#%02x%02x%02x", &c.R, &c.G, &c.B)
+	return err
+}
+
+func TestTextMarshaler(t *testing.T) {
+	type theme struct {
+		Name       string
+		Background color
+		Palette    []color
+		Updated    time.Time
+		Any        any
+	}
+
+	types := NewTypes().MustRegister(Type("color", color{}))
+
+	x := &theme{
+		Name:       "dark",
+		Background: color{0x10, 0x20, 0x30},
+		Palette:    []color{{0xff, 0, 0}},
+		Updated:    time.Date(2024, 5, 6, 7, 8, 9, 10, time.UTC),
+		Any:        color{1, 2, 3},
+	}
+
+	objects, err := Marshal(x, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	expect := map[string]any{
+		"Name":       "dark",
+		"Background": "#102030",
+		"Palette":    []any{"#ff0000"},
+		"Updated":    "2024-05-06T07:08:09.00000001Z",
+		"Any":        map[string]any{"color": "#010203"},
+	}
+	if !reflect.DeepEqual(objects[0], expect) {
+		t.Errorf("marshaled: %#v", objects[0])
+	}
+
+	y := new(theme)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+
+	objects[0].(map[string]any)["Background"] = "red"
+
+	if err := Unmarshal(objects, new(theme), types); err == nil {
+		t.Error("invalid text was accepted")
+	}
+}
+
+func TestTime(t *testing.T) {
+	type record struct {
+		Created time.Time
+		Expires *time.Time
+		Zero    time.Time
+	}
+
+	now := time.Now() // Has monotonic clock reading.
+	expires := now.In(time.FixedZone("X", 3600)).Add(time.Hour)
+	x := &record{Created: now, Expires: &expires}
+
+	objects, err := Marshal(x, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	if s := objects[0].(map[string]any)["Created"]; s != now.Format(time.RFC3339Nano) {
+		t.Errorf("created: %#v", s)
+	}
+
+	y := new(record)
+	if err := Unmarshal(objects, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	if !y.Created.Equal(now) {
+		t.Error("created:", y.Created)
+	}
+	if !y.Expires.Equal(expires) {
+		t.Error("expires:", y.Expires)
+	}
+	if _, offset := y.Expires.Zone(); offset != 3600 {
+		t.Error("zone offset:", offset)
+	}
+	if !y.Zero.IsZero() {
+		t.Error("zero:", y.Zero)
+	}
+	if strings.Contains(y.Created.String(), "m=") {
+		t.Error("monotonic clock reading was not stripped")
+	}
+}
+
+func TestTimeMapKeys(t *testing.T) {
+	type calendar struct {
+		Events map[time.Time]int
+	}
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	x := &calendar{
+		Events: map[time.Time]int{
+			base:                 1,
+			base.Add(time.Hour):  2,
+			base.Add(-time.Hour): 3,
+		},
+	}
+
+	for _, opts := range []Options{{}, {MapAsEntries: true}} {
+		objects, err := MarshalOptions(x, NewTypes(), opts)
+		if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+
+		events := objects[0].(map[string]any)["Events"]
+		if opts.MapAsEntries {
+			first := events.([]any)[0].([]any)
+			if first[0] != "2024-05-01T11:00:00Z" || first[1] != 3 {
+				t.Errorf("first entry: %#v", first)
+			}
+		} else if n := events.(map[string]any)["2024-05-01T12:00:00Z"]; n != 1 {
+			t.Errorf("events: %#v", events)
+		}
+
+		y := new(calendar)
+		if err := UnmarshalOptions(objects, y, NewTypes(), opts); err != nil {
+			t.Fatal("unmarshal error:", err)
+		}
+		if !reflect.DeepEqual(x, y) {
+			t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+		}
+	}
+}
+
+func TestBigNumbers(t *testing.T) {
+	type ledger struct {
+		Balance *big.Int
+		Limit   *big.Int
+		Rate    *big.Rat
+		Value   big.Int
+	}
+
+	n, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	x := &ledger{n, n, big.NewRat(1, 3), *big.NewInt(-5)}
+
+	objects, err := Marshal(x, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	expect := []any{
+		map[string]any{"Balance": 1, "Limit": 1, "Rate": 2, "Value": "-5"},
+		"123456789012345678901234567890",
+		"1/3",
+	}
+	if !reflect.DeepEqual(objects, expect) {
+		t.Errorf("objects: %#v", objects)
+	}
+
+	y := new(ledger)
+	if err := Unmarshal(objects, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	if y.Balance.Cmp(n) != 0 || y.Rate.Cmp(x.Rate) != 0 || y.Value.Int64() != -5 {
+		t.Errorf("values: %v %v %v", y.Balance, y.Rate, &y.Value)
+	}
+	if y.Balance != y.Limit {
+		t.Error("sharing was not preserved")
+	}
+}
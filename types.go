@@ -6,7 +6,13 @@ package marshal
 import (
 	"errors"
 	"fmt"
+	"maps"
 	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
 )
 
 type TypeParam struct {
@@ -23,18 +29,120 @@ func TypeName(value any) TypeParam {
 	return TypeParam{t.Name(), t}
 }
 
+// TypeOf is like Type, but the type is specified as a type argument.  It
+// doesn't require a value of the type.
+func TypeOf[T any](name string) TypeParam {
+	return TypeParam{name, reflect.TypeFor[T]()}
+}
+
+// TypeNameOf is like TypeName, but the type is specified as a type argument.
+func TypeNameOf[T any]() TypeParam {
+	t := reflect.TypeFor[T]()
+	return TypeParam{t.Name(), t}
+}
+
+// Types is a registry of type names.  It may be used concurrently, also while
+// registering types.
 type Types struct {
-	typeNames map[reflect.Type]string
-	nameTypes map[string]reflect.Type
+	mu         sync.RWMutex
+	typeNames  map[reflect.Type]string
+	nameTypes  map[string]reflect.Type
+	lazy       map[string]func() reflect.Type
+	codecs     []*codec
+	factories  map[[2]reflect.Type]reflect.Value
+	unexported map[reflect.Type]bool
+	deepCheck  bool
 }
 
 func NewTypes() *Types {
 	return &Types{
-		make(map[reflect.Type]string),
-		make(map[string]reflect.Type),
+		typeNames:  make(map[reflect.Type]string),
+		nameTypes:  make(map[string]reflect.Type),
+		lazy:       make(map[string]func() reflect.Type),
+		factories:  make(map[[2]reflect.Type]reflect.Value),
+		unexported: make(map[reflect.Type]bool),
+	}
+}
+
+// Clone returns a copy of the registry.  Registrations made with either one
+// don't affect the other.
+func (ts *Types) Clone() *Types {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return &Types{
+		typeNames:  maps.Clone(ts.typeNames),
+		nameTypes:  maps.Clone(ts.nameTypes),
+		lazy:       maps.Clone(ts.lazy),
+		codecs:     slices.Clone(ts.codecs),
+		factories:  maps.Clone(ts.factories),
+		unexported: maps.Clone(ts.unexported),
+		deepCheck:  ts.deepCheck,
 	}
 }
 
+// Merge copies the registrations of other into ts.  Names and types which are
+// registered identically in both are accepted.  If there are conflicting
+// registrations, the errors are joined and ts is not modified.
+func (ts *Types) Merge(other *Types) error {
+	if other == ts {
+		return nil
+	}
+	other = other.Clone() // Avoid holding both locks.
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var errs []error
+
+	for name, t := range other.nameTypes {
+		if existing, found := ts.nameTypes[name]; found {
+			if existing != t {
+				errs = append(errs, fmt.Errorf("marshal: type name already registered: %q", name))
+			}
+		} else if ts.nameTaken(name) {
+			errs = append(errs, fmt.Errorf("marshal: type name already registered: %q", name))
+		}
+	}
+	for t, name := range other.typeNames {
+		if existing, found := ts.typeNames[t]; found && existing != name {
+			errs = append(errs, fmt.Errorf("marshal: type already registered: %s", t))
+		} else if c := ts.findCodec(t); c != nil && c.t == t {
+			errs = append(errs, fmt.Errorf("marshal: type already registered: %s", t))
+		}
+	}
+	for name := range other.lazy {
+		if ts.nameTaken(name) {
+			errs = append(errs, fmt.Errorf("marshal: type name already registered: %q", name))
+		}
+	}
+	for _, c := range other.codecs {
+		if ts.nameTaken(c.name) {
+			errs = append(errs, fmt.Errorf("marshal: type name already registered: %q", c.name))
+		}
+		if _, found := ts.typeNames[c.t]; found || ts.findCodec(c.t) != nil {
+			errs = append(errs, fmt.Errorf("marshal: type already registered: %s", c.t))
+		}
+	}
+	for key, v := range other.factories {
+		if _, found := ts.factories[key]; found {
+			errs = append(errs, fmt.Errorf("marshal: function factory already registered: %s", v.Type()))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	maps.Copy(ts.typeNames, other.typeNames)
+	maps.Copy(ts.nameTypes, other.nameTypes)
+	maps.Copy(ts.lazy, other.lazy)
+	ts.codecs = append(ts.codecs, other.codecs...)
+	maps.Copy(ts.factories, other.factories)
+	maps.Copy(ts.unexported, other.unexported)
+	return nil
+}
+
 func (ts *Types) Register(args ...TypeParam) error {
 	var errs []error
 
@@ -55,6 +163,31 @@ func (ts *Types) MustRegister(args ...TypeParam) *Types {
 	return ts
 }
 
+// RegisterAll registers the types of the values using their package-qualified
+// names, such as "example.net/pkg.Type" or "*example.net/pkg.Type".
+func (ts *Types) RegisterAll(values ...any) error {
+	var errs []error
+
+	for _, value := range values {
+		t := reflect.ValueOf(value).Type()
+		if err := ts.register(qualifiedName(t), t); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// TryRegister registers the types which can be registered, and ignores
+// duplicates and other registration errors.
+func (ts *Types) TryRegister(args ...TypeParam) *Types {
+	for _, arg := range args {
+		ts.register(arg.name, arg.t)
+	}
+
+	return ts
+}
+
 func (ts *Types) RegisterType(name string, value any) error {
 	return ts.register(name, reflect.ValueOf(value).Type())
 }
@@ -64,17 +197,170 @@ func (ts *Types) RegisterTypeName(value any) error {
 	return ts.register(t.Name(), t)
 }
 
+// RegisterGeneric registers type T under name.  It is convenient for generic
+// instantiations, which need distinct names such as "Box[int]" and
+// "Box[string]".
+func RegisterGeneric[T any](ts *Types, name string) error {
+	return ts.register(name, reflect.TypeFor[T]())
+}
+
+// RegisterLazy defers the registration of a type until it is needed.  The
+// factory is called when the name is encountered during unmarshaling.
+// Marshaling runs all pending lazy registrations when it encounters a type
+// which hasn't been registered (such as an int held by an empty interface).
+// Registration errors are reported at that point.  A failed registration
+// remains pending, so the error is reported again by subsequent operations
+// until the name is unregistered.
+//
+// The factory is called while the registry is locked, so it must not use the
+// registry.
+func (ts *Types) RegisterLazy(name string, factory func() reflect.Type) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.lazy[name] = factory
+}
+
+// RegisterAlias registers an additional name for the type registered as
+// canonical.  Both names are accepted when unmarshaling, but only the
+// canonical name is used when marshaling.
+func (ts *Types) RegisterAlias(alias, canonical string) error {
+	t, found, err := ts.typeFor(canonical)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("marshal: %w", &UnregisteredTypeError{Name: canonical})
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if alias == "" {
+		return fmt.Errorf("marshal: no alias for type: %s", t)
+	}
+	if err := checkTypeName(alias, t); err != nil {
+		return err
+	}
+	if ts.nameTaken(alias) {
+		return fmt.Errorf("marshal: type name already registered: %q", alias)
+	}
+
+	ts.nameTypes[alias] = t
+	return nil
+}
+
+// Unregister removes a registered type, alias, codec or pending lazy
+// registration by name.  Unregistering a type also removes its aliases.  The
+// name and the type can be registered again afterwards.
+func (ts *Types) Unregister(name string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if t, found := ts.nameTypes[name]; found {
+		delete(ts.nameTypes, name)
+
+		if ts.typeNames[t] == name {
+			delete(ts.typeNames, t)
+			maps.DeleteFunc(ts.nameTypes, func(_ string, alias reflect.Type) bool {
+				return alias == t
+			})
+		}
+		return nil
+	}
+
+	if _, found := ts.lazy[name]; found {
+		delete(ts.lazy, name)
+		return nil
+	}
+
+	for i, c := range ts.codecs {
+		if c.name == name {
+			ts.codecs = slices.Delete(ts.codecs, i, i+1)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("marshal: %w", &UnregisteredTypeError{Name: name})
+}
+
+// Registered returns the sorted names of registered types, aliases, codecs and
+// pending lazy registrations.
+func (ts *Types) Registered() []string {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	names := make([]string, 0, len(ts.nameTypes)+len(ts.lazy)+len(ts.codecs))
+	for name := range ts.nameTypes {
+		names = append(names, name)
+	}
+	for name := range ts.lazy {
+		names = append(names, name)
+	}
+	for _, c := range ts.codecs {
+		names = append(names, c.name)
+	}
+
+	slices.Sort(names)
+	return names
+}
+
+// TypeFor looks up a type by registered name, alias or codec name.  A pending
+// lazy registration is resolved if necessary; false is returned if that fails.
+func (ts *Types) TypeFor(name string) (reflect.Type, bool) {
+	if t, found, err := ts.typeFor(name); err == nil && found {
+		return t, true
+	}
+	if c := ts.codecByName(name); c != nil {
+		return c.t, true
+	}
+	return nil, false
+}
+
+// NameFor looks up the registered name or codec name of a type.  Pending lazy
+// registrations are resolved if necessary; false is returned if that fails.
+func (ts *Types) NameFor(t reflect.Type) (string, bool) {
+	if name, found, err := ts.nameFor(t); err == nil && found {
+		return name, true
+	}
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	for _, c := range ts.codecs {
+		if c.t == t {
+			return c.name, true
+		}
+	}
+	return "", false
+}
+
 func (ts *Types) register(name string, t reflect.Type) error {
-	if name == "" {
-		return fmt.Errorf("marshal: no name for type: %s", t)
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.registerLocked(name, t)
+}
+
+func (ts *Types) registerLocked(name string, t reflect.Type) error {
+	if err := checkTypeName(name, t); err != nil {
+		return err
 	}
 	if !isTypeSupported(t) {
-		return fmt.Errorf("marshal: type not supported: %s", t)
+		return fmt.Errorf("marshal: %w", &UnsupportedTypeError{t})
+	}
+	if ts.deepCheck {
+		if nested := ts.unsupportedNested(t, make(map[reflect.Type]bool)); nested != nil {
+			return fmt.Errorf("marshal: %s contains %w", t, &UnsupportedTypeError{nested})
+		}
 	}
 	if _, found := ts.typeNames[t]; found {
 		return fmt.Errorf("marshal: type already registered: %s", t)
 	}
-	if _, found := ts.nameTypes[name]; found {
+	if c := ts.findCodec(t); c != nil && c.t == t {
+		return fmt.Errorf("marshal: type already registered: %s", t)
+	}
+	if ts.nameTaken(name) {
 		return fmt.Errorf("marshal: type name already registered: %q", name)
 	}
 
@@ -83,6 +369,293 @@ func (ts *Types) register(name string, t reflect.Type) error {
 	return nil
 }
 
+// reservedPrefix of map keys which are not type names.
+const reservedPrefix = "$"
+
+// checkTypeName rejects names which are empty, start with reservedPrefix, or
+// contain control characters or invalid UTF-8.
+func checkTypeName(name string, t reflect.Type) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("marshal: no name for type: %s", t)
+	case strings.HasPrefix(name, reservedPrefix):
+		return fmt.Errorf("marshal: type name starts with reserved prefix %q: %q", reservedPrefix, name)
+	case !utf8.ValidString(name):
+		return fmt.Errorf("marshal: type name is not valid UTF-8: %q", name)
+	case strings.ContainsFunc(name, unicode.IsControl):
+		return fmt.Errorf("marshal: type name contains control characters: %q", name)
+	default:
+		return nil
+	}
+}
+
+func (ts *Types) nameTaken(name string) bool {
+	if _, found := ts.nameTypes[name]; found {
+		return true
+	}
+	if _, found := ts.lazy[name]; found {
+		return true
+	}
+	return ts.findCodecByName(name) != nil
+}
+
+// nameFor looks up the name of a registered type.  Pending lazy registrations
+// are resolved if the type is not found.
+func (ts *Types) nameFor(t reflect.Type) (string, bool, error) {
+	ts.mu.RLock()
+	name, found := ts.typeNames[t]
+	ts.mu.RUnlock()
+	if found {
+		return name, true, nil
+	}
+
+	if err := ts.resolveLazy(); err != nil {
+		return "", false, err
+	}
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	name, found = ts.typeNames[t]
+	return name, found, nil
+}
+
+// implementation finds a registered type which implements an interface type.
+// The number of such types is also returned.  Pending lazy registrations are
+// resolved first.
+func (ts *Types) implementation(iface reflect.Type) (reflect.Type, int, error) {
+	if err := ts.resolveLazy(); err != nil {
+		return nil, 0, err
+	}
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	var (
+		impl reflect.Type
+		n    int
+	)
+
+	for t := range ts.typeNames {
+		if t.Implements(iface) {
+			impl = t
+			n++
+		}
+	}
+
+	return impl, n, nil
+}
+
+// resolveLazy registers all pending lazy registrations.
+func (ts *Types) resolveLazy() error {
+	ts.mu.RLock()
+	pending := len(ts.lazy)
+	ts.mu.RUnlock()
+	if pending == 0 {
+		return nil
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var errs []error
+
+	for name := range ts.lazy {
+		if _, _, err := ts.resolveLazyName(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// typeFor looks up a registered type by name.  A pending lazy registration is
+// resolved if necessary.
+func (ts *Types) typeFor(name string) (reflect.Type, bool, error) {
+	ts.mu.RLock()
+	t, found := ts.nameTypes[name]
+	ts.mu.RUnlock()
+	if found {
+		return t, true, nil
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if t, found := ts.nameTypes[name]; found {
+		return t, true, nil // Resolved concurrently.
+	}
+
+	return ts.resolveLazyName(name)
+}
+
+// resolveLazyName registers a pending lazy registration.  The write lock must
+// be held.
+func (ts *Types) resolveLazyName(name string) (reflect.Type, bool, error) {
+	factory, found := ts.lazy[name]
+	if !found {
+		return nil, false, nil
+	}
+	delete(ts.lazy, name)
+
+	t := factory()
+	if err := ts.registerLocked(name, t); err != nil {
+		ts.lazy[name] = factory // Report the error again.
+		return nil, false, err
+	}
+
+	return t, true, nil
+}
+
+// RegisterFuncFactory registers a function of the form func(Config) F, where F
+// is a function type.  It is used to reconstruct struct fields of type F which
+// are tagged with `marshal:",via=Field"`, where Field is of type Config.
+func (ts *Types) RegisterFuncFactory(factory any) error {
+	if factory == nil {
+		return errors.New("marshal: nil function factory")
+	}
+
+	v := reflect.ValueOf(factory)
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 1 || t.NumOut() != 1 || t.Out(0).Kind() != reflect.Func || t.IsVariadic() {
+		return fmt.Errorf("marshal: not a function factory: %s", t)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	key := [2]reflect.Type{t.In(0), t.Out(0)}
+	if _, found := ts.factories[key]; found {
+		return fmt.Errorf("marshal: function factory already registered: %s", t)
+	}
+
+	ts.factories[key] = v
+	return nil
+}
+
+func (ts *Types) funcFactory(config, fn reflect.Type) (reflect.Value, bool) {
+	if ts == nil {
+		return reflect.Value{}, false
+	}
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	factory, found := ts.factories[[2]reflect.Type{config, fn}]
+	return factory, found
+}
+
+// AllowUnexported permits the unexported fields of the given struct types to
+// be marshaled and unmarshaled.  The fields are accessed using package unsafe;
+// the unexported fields of other types are ignored.
+func (ts *Types) AllowUnexported(values ...any) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var errs []error
+
+	for _, value := range values {
+		t := reflect.ValueOf(value).Type()
+		if t.Kind() != reflect.Struct {
+			errs = append(errs, fmt.Errorf("marshal: not a struct type: %s", t))
+			continue
+		}
+
+		ts.unexported[t] = true
+	}
+
+	return errors.Join(errs...)
+}
+
+// CheckNestedTypes enables or disables checking of struct fields, elements and
+// map entries when registering types.  When enabled, registration fails if a
+// type contains a channel, function or unsafe pointer, or a map with an
+// unsupported key type, which would fail to marshal (or be dropped with
+// Options.IgnoreUnsupportedTypes).  Skipped fields, function fields with a via
+// option, unexported fields (unless allowed) and types with their own
+// marshaling methods are not checked.  Struct tags are interpreted using the
+// default tag key.
+func (ts *Types) CheckNestedTypes(enable bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.deepCheck = enable
+}
+
+// unsupportedNested finds an unsupported type within t.  The lock must be
+// held.
+func (ts *Types) unsupportedNested(t reflect.Type, seen map[reflect.Type]bool) reflect.Type {
+	if t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType) || t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType) {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Array, reflect.Pointer, reflect.Slice:
+		return ts.unsupportedNested(t.Elem(), seen)
+
+	case reflect.Map:
+		if !isMapKeyTypeSupported(t.Key()) {
+			return t
+		}
+		return ts.unsupportedNested(t.Elem(), seen)
+
+	case reflect.Struct:
+		if seen[t] {
+			return nil
+		}
+		seen[t] = true
+
+		fields, err := structFields(t, defaultTagKey)
+		if err != nil {
+			return nil // Reported when marshaling.
+		}
+
+		for _, f := range fields {
+			if (!f.IsExported() && !ts.unexported[t]) || f.via != "" {
+				continue
+			}
+			if nested := ts.unsupportedNested(f.Type, seen); nested != nil {
+				return nested
+			}
+		}
+		return nil
+
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return t
+
+	default:
+		return nil
+	}
+}
+
+func (ts *Types) allowsUnexported(t reflect.Type) bool {
+	if ts == nil {
+		return false
+	}
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	return ts.unexported[t]
+}
+
+func qualifiedName(t reflect.Type) string {
+	if t.Kind() == reflect.Pointer {
+		if name := qualifiedName(t.Elem()); name != "" {
+			return "*" + name
+		}
+		return ""
+	}
+
+	if t.Name() == "" {
+		return ""
+	}
+	if t.PkgPath() == "" {
+		return t.Name()
+	}
+	return t.PkgPath() + "." + t.Name()
+}
+
 func isTypeSupported(t reflect.Type) bool {
 	for t.Kind() == reflect.Pointer {
 		t = t.Elem()
@@ -103,6 +676,6 @@ func isMapKeyTypeSupported(t reflect.Type) bool {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr, reflect.String:
 		return true
 	default:
-		return false
+		return isTextKeyType(t)
 	}
 }
@@ -0,0 +1,513 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTryRegister(t *testing.T) {
+	types := NewTypes().TryRegister(
+		TypeName(alt1{}),
+		Type("alt2ptr", &alt2{}),
+	).TryRegister(
+		Type("alt2ptr", &alt2{}),
+		Type("alt1again", alt1{}),
+		Type("alt2", alt2{}),
+		Type("func", func() {}),
+	)
+
+	for name, value := range map[string]any{
+		"alt1":    alt1{},
+		"alt2ptr": &alt2{},
+		"alt2":    alt2{},
+	} {
+		if typ, found := types.nameTypes[name]; !found || typ != reflect.TypeOf(value) {
+			t.Errorf("%q: %v", name, typ)
+		}
+	}
+
+	for _, name := range []string{"alt1again", "func"} {
+		if _, found := types.nameTypes[name]; found {
+			t.Errorf("%q registered", name)
+		}
+	}
+}
+
+func TestRegisterLazy(t *testing.T) {
+	type holder struct {
+		Value alt
+	}
+
+	types := NewTypes()
+	var resolved []string
+
+	lazy := func(name string, value any) {
+		types.RegisterLazy(name, func() reflect.Type {
+			resolved = append(resolved, name)
+			return reflect.TypeOf(value)
+		})
+	}
+	lazy("alt1", alt1{})
+	lazy("alt2ptr", &alt2{})
+
+	if err := types.Register(Type("alt1", alt1{})); err == nil {
+		t.Error("lazily registered name was registered again")
+	}
+
+	sources := []any{
+		map[string]any{"Value": map[string]any{"alt2ptr": 1}},
+		map[string]any{"Alt2": "lazy"},
+	}
+
+	x := new(holder)
+	if err := Unmarshal(sources, x, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, &holder{&alt2{"lazy"}}) {
+		t.Errorf("unmarshaled: %#v", x)
+	}
+	if !reflect.DeepEqual(resolved, []string{"alt2ptr"}) {
+		t.Error("resolved:", resolved)
+	}
+
+	objects, err := Marshal(&holder{alt1{"marshal"}}, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if !reflect.DeepEqual(objects, []any{map[string]any{"Value": map[string]any{"alt1": map[string]any{"Alt1": "marshal"}}}}) {
+		t.Errorf("marshaled: %#v", objects)
+	}
+	if !reflect.DeepEqual(resolved, []string{"alt2ptr", "alt1"}) {
+		t.Error("resolved:", resolved)
+	}
+
+	lazy("conflict", alt1{})
+
+	for range 2 {
+		if _, err := Marshal(&struct{ Value any }{42}, types, false); err == nil || !strings.Contains(err.Error(), "already registered") {
+			t.Error("conflicting lazy registration error:", err)
+		}
+	}
+
+	if err := types.Unregister("conflict"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Marshal(&struct{ Value any }{42}, types, false); err != nil {
+		t.Error("marshal error:", err)
+	}
+}
+
+func TestRegisterAll(t *testing.T) {
+	types := NewTypes()
+
+	if err := types.RegisterAll(alt1{}, &alt2{}, square{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range map[string]any{
+		"github.com/tsavola/marshal.alt1":   alt1{},
+		"*github.com/tsavola/marshal.alt2":  &alt2{},
+		"github.com/tsavola/marshal.square": square{},
+	} {
+		if typ := types.nameTypes[name]; typ != reflect.TypeOf(value) {
+			t.Errorf("%q: %v", name, typ)
+		}
+	}
+
+	if err := types.RegisterAll(alt1{}, struct{}{}, 0); err == nil {
+		t.Error("duplicate and unnamed types were registered")
+	} else if _, found := types.nameTypes["int"]; !found {
+		t.Error("valid type was not registered alongside errors")
+	}
+
+	type holder struct {
+		Alt   alt
+		Shape shape
+	}
+
+	for _, x := range []*holder{
+		{alt1{"one"}, square{1}},
+		{&alt2{"two"}, nil},
+	} {
+		objects, err := Marshal(x, types, false)
+		if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+
+		y := new(holder)
+		if err := Unmarshal(objects, y, types); err != nil {
+			t.Fatal("unmarshal error:", err)
+		}
+
+		if !reflect.DeepEqual(x, y) {
+			t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+		}
+	}
+}
+
+type box[T any] struct {
+	Value T
+}
+
+func TestRegisterGeneric(t *testing.T) {
+	ts := NewTypes()
+	if err := RegisterGeneric[*box[int]](ts, "Box[int]"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterGeneric[*box[string]](ts, "Box[string]"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterGeneric[*box[int]](ts, "Box[int64]"); err == nil {
+		t.Error("duplicate instantiation registered")
+	}
+
+	type holder struct {
+		A any
+		B any
+	}
+
+	x := &holder{&box[int]{42}, &box[string]{"hello"}}
+
+	objects, err := Marshal(x, ts, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	y := new(holder)
+	if err := Unmarshal(objects, y, ts); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	if b, ok := y.A.(*box[int]); !ok || b.Value != 42 {
+		t.Errorf("A: %#v", y.A)
+	}
+	if b, ok := y.B.(*box[string]); !ok || b.Value != "hello" {
+		t.Errorf("B: %#v", y.B)
+	}
+}
+
+func TestTypeOf(t *testing.T) {
+	ts := NewTypes()
+	if err := ts.Register(TypeNameOf[alt1](), TypeOf[*alt2]("alt2ptr")); err != nil {
+		t.Fatal(err)
+	}
+
+	x := &struct{ A, B alt }{alt1{"one"}, &alt2{"two"}}
+
+	objects, err := Marshal(x, ts, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if w := objects[0].(map[string]any)["A"]; !reflect.DeepEqual(w, map[string]any{"alt1": map[string]any{"Alt1": "one"}}) {
+		t.Errorf("wrapper: %#v", w)
+	}
+
+	y := &struct{ A, B alt }{}
+	if err := Unmarshal(objects, y, ts); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	ts := NewTypes().MustRegister(TypeName(alt1{}))
+	ts.RegisterLazy("lazy", func() reflect.Type { return reflect.TypeFor[alt2]() })
+
+	x := &struct{ Alt alt }{alt1{"value"}}
+
+	if _, err := Marshal(x, ts, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.Unregister("alt1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Unregister("alt1"); err == nil {
+		t.Error("name was unregistered twice")
+	}
+	if err := ts.Unregister("lazy"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Marshal(x, ts, false); err == nil {
+		t.Error("unregistered type was marshaled")
+	}
+
+	if err := ts.Register(Type("alt1", &alt2{})); err != nil {
+		t.Fatal("name could not be reused:", err)
+	}
+	if err := ts.Register(Type("alt1-again", alt1{})); err != nil {
+		t.Fatal("type could not be reused:", err)
+	}
+
+	objects, err := Marshal(x, ts, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := objects[0].(map[string]any)["Alt"]; !reflect.DeepEqual(w, map[string]any{"alt1-again": map[string]any{"Alt1": "value"}}) {
+		t.Errorf("wrapper: %#v", w)
+	}
+}
+
+func TestClone(t *testing.T) {
+	base := NewTypes().MustRegister(TypeName(alt1{}))
+
+	clone := base.Clone()
+	if err := clone.Register(Type("alt2ptr", &alt2{})); err != nil {
+		t.Fatal(err)
+	}
+	if err := clone.Unregister("alt1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found, _ := base.nameFor(reflect.TypeFor[*alt2]()); found {
+		t.Error("registration on clone affected base")
+	}
+	if name, found, _ := base.nameFor(reflect.TypeFor[alt1]()); !found || name != "alt1" {
+		t.Error("unregistration on clone affected base")
+	}
+
+	if err := base.Register(Type("extra", &event{})); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := clone.typeFor("extra"); found {
+		t.Error("registration on base affected clone")
+	}
+}
+
+func TestTypesMerge(t *testing.T) {
+	core := NewTypes().MustRegister(TypeName(alt1{}))
+	if err := core.RegisterAlias("legacy", "alt1"); err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := NewTypes().MustRegister(TypeName(alt1{}), Type("alt2ptr", &alt2{}))
+	plugin.RegisterLazy("lazy", func() reflect.Type { return reflect.TypeFor[event]() })
+
+	if err := core.Merge(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if names := core.Registered(); !reflect.DeepEqual(names, []string{"alt1", "alt2ptr", "lazy", "legacy"}) {
+		t.Error("registered:", names)
+	}
+	if names := plugin.Registered(); !reflect.DeepEqual(names, []string{"alt1", "alt2ptr", "lazy"}) {
+		t.Error("merge affected other:", names)
+	}
+
+	conflict := NewTypes().MustRegister(Type("alt1", &alt2{}), Type("other", alt1{}), TypeName(event{}))
+	err := core.Merge(conflict)
+	if err == nil {
+		t.Fatal("conflicts were not reported")
+	}
+	if n := len(err.(interface{ Unwrap() []error }).Unwrap()); n != 3 {
+		t.Errorf("%d errors: %v", n, err)
+	}
+	if names := core.Registered(); !reflect.DeepEqual(names, []string{"alt1", "alt2ptr", "lazy", "legacy"}) {
+		t.Error("conflicting merge modified registry:", names)
+	}
+}
+
+func TestConcurrentRegistration(t *testing.T) {
+	ts := NewTypes().MustRegister(TypeName(alt1{}))
+
+	var wg sync.WaitGroup
+
+	for i := range 8 {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			ts.RegisterLazy(fmt.Sprintf("lazy%d", i), func() reflect.Type {
+				return reflect.ArrayOf(i, reflect.TypeFor[int]())
+			})
+			ts.Register(Type(fmt.Sprintf("type%d", i), reflect.New(reflect.ArrayOf(i+100, reflect.TypeFor[int]())).Elem().Interface()))
+		}()
+
+		go func() {
+			defer wg.Done()
+			x := &struct{ Alt alt }{alt1{"value"}}
+			objects, err := Marshal(x, ts, false)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := Unmarshal(objects, new(struct{ Alt alt }), ts); err != nil {
+				t.Error(err)
+			}
+			if _, err := ts.ExportSchema(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestRegisterAlias(t *testing.T) {
+	ts := NewTypes().MustRegister(Type("new", alt1{}))
+
+	if err := ts.RegisterAlias("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.RegisterAlias("old", "new"); err == nil {
+		t.Error("alias was registered twice")
+	}
+	if err := ts.RegisterAlias("other", "missing"); err == nil {
+		t.Error("alias was registered for unknown name")
+	}
+
+	type holder struct {
+		Alt alt
+	}
+
+	for _, name := range []string{"old", "new"} {
+		sources := []any{map[string]any{"Alt": map[string]any{name: map[string]any{"Alt1": name}}}}
+
+		x := new(holder)
+		if err := Unmarshal(sources, x, ts); err != nil {
+			t.Fatal(err)
+		}
+		if x.Alt != (alt1{name}) {
+			t.Errorf("%s: %#v", name, x.Alt)
+		}
+	}
+
+	objects, err := Marshal(&holder{alt1{"value"}}, ts, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := objects[0].(map[string]any)["Alt"]; !reflect.DeepEqual(w, map[string]any{"new": map[string]any{"Alt1": "value"}}) {
+		t.Errorf("wrapper: %#v", w)
+	}
+
+	if err := ts.Unregister("old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := ts.nameFor(reflect.TypeFor[alt1]()); !found {
+		t.Error("unregistering alias removed type")
+	}
+
+	if err := ts.RegisterAlias("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Unregister("new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := ts.typeFor("old"); found {
+		t.Error("alias was not removed with type")
+	}
+}
+
+func TestRegistered(t *testing.T) {
+	ts := NewTypes().MustRegister(TypeName(alt1{}))
+	if err := ts.RegisterAlias("legacy", "alt1"); err != nil {
+		t.Fatal(err)
+	}
+	ts.RegisterLazy("lazy", func() reflect.Type { return reflect.TypeFor[alt2]() })
+	if err := RegisterCodec(ts, "duration", func(d time.Duration) (int64, error) {
+		return int64(d), nil
+	}, func(n int64) (time.Duration, error) {
+		return time.Duration(n), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := ts.Registered(); !reflect.DeepEqual(names, []string{"alt1", "duration", "lazy", "legacy"}) {
+		t.Error("registered:", names)
+	}
+
+	if typ, found := ts.TypeFor("legacy"); !found || typ != reflect.TypeFor[alt1]() {
+		t.Error("alias:", typ, found)
+	}
+	if typ, found := ts.TypeFor("lazy"); !found || typ != reflect.TypeFor[alt2]() {
+		t.Error("lazy:", typ, found)
+	}
+	if typ, found := ts.TypeFor("duration"); !found || typ != reflect.TypeFor[time.Duration]() {
+		t.Error("codec:", typ, found)
+	}
+	if typ, found := ts.TypeFor("missing"); found {
+		t.Error("missing:", typ)
+	}
+
+	if name, found := ts.NameFor(reflect.TypeFor[alt1]()); !found || name != "alt1" {
+		t.Error("name:", name, found)
+	}
+	if name, found := ts.NameFor(reflect.TypeFor[time.Duration]()); !found || name != "duration" {
+		t.Error("codec name:", name, found)
+	}
+	if name, found := ts.NameFor(reflect.TypeFor[*alt2]()); found {
+		t.Error("unregistered:", name)
+	}
+}
+
+func TestTypeNameValidation(t *testing.T) {
+	for _, name := range []string{"", "$type", "tab\tname", "nul\x00", "bad\xff"} {
+		if err := NewTypes().Register(Type(name, alt1{})); err == nil {
+			t.Errorf("name %q was accepted", name)
+		}
+	}
+
+	for _, name := range []string{"alt1", "example.com/pkg.Type", "type$", "名前", "with space"} {
+		if err := NewTypes().Register(Type(name, alt1{})); err != nil {
+			t.Errorf("name %q: %v", name, err)
+		}
+	}
+
+	ts := NewTypes().MustRegister(TypeName(alt1{}))
+	if err := ts.RegisterAlias("$alias", "alt1"); err == nil {
+		t.Error("reserved alias was accepted")
+	}
+	if err := RegisterCodec(ts, "$codec", func(d time.Duration) (int64, error) {
+		return int64(d), nil
+	}, func(n int64) (time.Duration, error) {
+		return time.Duration(n), nil
+	}); err == nil {
+		t.Error("reserved codec name was accepted")
+	}
+}
+
+func TestCheckNestedTypes(t *testing.T) {
+	type worker struct {
+		Name  string
+		Queue chan int
+	}
+	type pool struct {
+		Workers []*worker
+	}
+	type quiet struct {
+		Name  string
+		Queue chan int `marshal:"-"`
+		mu    sync.Mutex
+		done  chan struct{}
+	}
+
+	ts := NewTypes()
+	if err := ts.Register(TypeName(pool{})); err != nil {
+		t.Error("registration failed without check:", err)
+	}
+
+	ts = NewTypes()
+	ts.CheckNestedTypes(true)
+
+	var unsupported *UnsupportedTypeError
+	err := ts.Register(TypeName(pool{}))
+	if !errors.As(err, &unsupported) || unsupported.Type != reflect.TypeFor[chan int]() {
+		t.Error("nested channel:", err)
+	}
+	if err := ts.Register(TypeName(quiet{})); err != nil {
+		t.Error("skipped fields were checked:", err)
+	}
+	if err := ts.Register(Type("time", time.Time{})); err != nil {
+		t.Error("text marshaler was checked:", err)
+	}
+}
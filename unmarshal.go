@@ -6,91 +6,316 @@ package marshal
 import (
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"slices"
 	"strconv"
 
 	"import.name/pan"
-
-	. "import.name/pan/mustcheck"
 )
 
+// Unmarshal decodes an object list into the value pointed to by ptr.  Empty
+// interface destinations receive generic values (maps, slices and scalars)
+// unless the source is wrapped with a registered type name.
+//
+// Struct fields are matched by name, so data can be decoded into a different
+// version of a struct type: source entries without a corresponding field are
+// ignored, fields without a source entry are left untouched, and field order
+// doesn't matter.
 func Unmarshal(sources []any, ptr any, types *Types) error {
+	return UnmarshalOptions(sources, ptr, types, Options{})
+}
+
+// UnmarshalAs is like Unmarshal, but it allocates the destination and returns
+// the decoded value.  If T is a pointer type, its target is the root object.
+// Otherwise the returned value is a copy of the root object, so pointers
+// within the graph which refer to the root don't refer to the returned value.
+func UnmarshalAs[T any](sources []any, types *Types) (T, error) {
+	var x T
+
+	if t := reflect.TypeFor[T](); t.Kind() == reflect.Pointer {
+		p := reflect.New(t.Elem())
+		if err := Unmarshal(sources, p.Interface(), types); err != nil {
+			return x, err
+		}
+		return p.Interface().(T), nil
+	}
+
+	err := Unmarshal(sources, &x, types)
+	return x, err
+}
+
+func UnmarshalOptions(sources []any, ptr any, types *Types, opts Options) error {
 	if reflect.TypeOf(ptr).Kind() != reflect.Pointer {
 		return errors.New("unmarshal: destination pointer expected")
 	}
 	if len(sources) == 0 {
 		return errors.New("unmarshal: nothing to unmarshal")
 	}
-
-	u := &unmarshaler{
-		types:   types,
-		sources: sources,
-		objects: make([]any, len(sources)),
+	if opts.MaxObjects > 0 && len(sources) > opts.MaxObjects {
+		return fmt.Errorf("unmarshal: %d objects exceed limit of %d", len(sources), opts.MaxObjects)
 	}
+
+	u := newUnmarshaler(sources, types, opts)
 	u.objects[0] = ptr
 
 	src := reflect.ValueOf(u.sources[0])
 	dest := reflect.ValueOf(ptr).Elem()
 
-	return pan.Recover(func() {
+	if err := pan.Recover(func() {
 		u.unmarshal(src, dest)
-	})
+	}); err != nil {
+		return u.path.wrap("unmarshal: ", err)
+	}
+
+	if opts.RequireAllReachable {
+		var orphans []int
+		for index, x := range u.objects {
+			if x == nil {
+				orphans = append(orphans, index)
+			}
+		}
+		if len(orphans) > 0 {
+			return fmt.Errorf("unmarshal: unreachable objects: %v", orphans)
+		}
+	}
+
+	return nil
+}
+
+// UnmarshalAny decodes an object list produced by MarshalEnvelope.  The type
+// of the root value is looked up from the registry using the envelope's type
+// name.
+func UnmarshalAny(sources []any, types *Types) (any, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("unmarshal: nothing to unmarshal")
+	}
+	if sources[0] == nil {
+		return nil, nil
+	}
+
+	u := newUnmarshaler(sources, types, Options{})
+
+	var x any
+
+	if err := pan.Recover(func() {
+		x = u.unmarshalWrapped(reflect.ValueOf(sources[0])).Interface()
+	}); err != nil {
+		return nil, u.path.wrap("unmarshal: ", err)
+	}
+
+	return x, nil
+}
+
+// UnmarshalDispatch decodes envelopes and passes their values to handle along
+// with their type names.  The root object may be a single envelope produced by
+// MarshalEnvelope, or a list of envelopes such as a marshaled []any containing
+// values of registered types.  Nil list items are skipped.  Decoding stops at
+// the first error returned by handle.
+func UnmarshalDispatch(sources []any, types *Types, handle func(name string, v any) error) error {
+	if len(sources) == 0 {
+		return errors.New("unmarshal: nothing to unmarshal")
+	}
+
+	envelopes, ok := sources[0].([]any)
+	if !ok {
+		envelopes = sources[:1]
+	}
+
+	u := newUnmarshaler(sources, types, Options{})
+
+	for _, src := range envelopes {
+		if src == nil {
+			continue
+		}
+
+		var (
+			name string
+			x    any
+		)
+
+		if err := pan.Recover(func() {
+			v := reflect.ValueOf(src)
+			x = u.unmarshalWrapped(v).Interface()
+			name, _, _ = unwrap(v, false)
+		}); err != nil {
+			return u.path.wrap("unmarshal: ", err)
+		}
+
+		if err := handle(name, x); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 type unmarshaler struct {
+	opts    Options
+	depth   int
+	path    path
 	types   *Types
 	sources []any
 	objects []any
 }
 
+func newUnmarshaler(sources []any, types *Types, opts Options) *unmarshaler {
+	return &unmarshaler{
+		opts:    opts.resolve(),
+		types:   types,
+		sources: sources,
+		objects: make([]any, len(sources)),
+	}
+}
+
 func (u *unmarshaler) unmarshal(src, dest reflect.Value) {
+	if u.opts.MaxDepth > 0 {
+		if u.depth >= u.opts.MaxDepth {
+			pan.Panic(errors.New("unmarshal: max depth exceeded"))
+		}
+		u.depth++
+		defer func() { u.depth-- }()
+	}
+
+	if src.IsValid() && src.Type() == jsonNumberType {
+		src = parseJSONNumber(src.String())
+	}
+
+	if x, ok := unmarshalGraph(dest); ok {
+		var r any
+		if src.IsValid() {
+			u.unmarshal(src, reflect.ValueOf(&r).Elem())
+		}
+		if err := x.UnmarshalGraph(r); err != nil {
+			pan.Panic(fmt.Errorf("unmarshal: %s: %w", dest.Type(), err))
+		}
+		afterUnmarshal(dest)
+		return
+	}
+
+	if src.Kind() == reflect.String && unmarshalText(src.String(), dest) {
+		afterUnmarshal(dest)
+		return
+	}
+
 	switch dest.Kind() {
 	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr, reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128, reflect.String:
-		// TODO: check src kind
-		dest.Set(src)
+		if dest.Kind() == reflect.String {
+			src = u.interned(src, dest.Type())
+		}
+		if (dest.Kind() == reflect.Complex64 || dest.Kind() == reflect.Complex128) && src.Kind() == reflect.Slice {
+			unmarshalComplex(src, dest)
+			break
+		}
+		if src.Kind() != dest.Kind() && !(isNumberKind(src.Kind()) && isNumberKind(dest.Kind())) {
+			if conv := u.opts.ScalarConverters[dest.Kind()]; conv != nil && src.IsValid() {
+				x, ok := conv(src.Interface())
+				if !ok {
+					pan.Panic(fmt.Errorf("unmarshal: cannot convert %s to %s", src.Type(), dest.Type()))
+				}
+				src = reflect.ValueOf(x)
+			}
+		}
+		if src.Kind() != dest.Kind() {
+			if isNumberKind(src.Kind()) && isNumberKind(dest.Kind()) {
+				coerceNumber(src, dest)
+				break
+			}
+			pan.Panic(fmt.Errorf("unmarshal: cannot unmarshal %s into %s", src.Kind(), dest.Type()))
+		}
+		dest.Set(src.Convert(dest.Type())) // Named type.
 
 	case reflect.Struct:
-		srcType := src.Type()
-		if srcType.Kind() != reflect.Map {
-			panic(src) // TODO
+		if dest.Type() == syncMapType {
+			u.unmarshalSyncMap(src, dest)
+			break
 		}
-		if srcType.Key().Kind() != reflect.String {
-			panic(src) // TODO
+		if src.Kind() != reflect.Map {
+			pan.Panic(fmt.Errorf("unmarshal: expected map for struct %s, got %s", dest.Type(), src.Kind()))
+		}
+		if srcType := src.Type(); srcType.Key().Kind() != reflect.String || srcType.Elem().Kind() != reflect.Interface {
+			pan.Panic(fmt.Errorf("unmarshal: expected map[string]any for struct %s, got %s", dest.Type(), srcType))
+		}
+
+		unexported := u.opts.IncludeUnexported || u.types.allowsUnexported(dest.Type())
+
+		fields, err := structFields(dest.Type(), u.opts.TagKey)
+		if err != nil {
+			pan.Panic(err)
 		}
-		if srcType.Elem().Kind() != reflect.Interface {
-			panic(src) // TODO
+
+		if u.opts.DisallowUnknownFields {
+			u.checkUnknownFields(src, dest.Type(), fields, unexported)
 		}
 
-		for _, f := range reflect.VisibleFields(dest.Type()) {
-			if f.IsExported() {
-				v := src.MapIndex(reflect.ValueOf(f.Name))
-				if v != (reflect.Value{}) {
-					u.unmarshal(v.Elem(), dest.FieldByIndex(f.Index))
+		var variants, funcs []field
+
+		for _, f := range fields {
+			if f.IsExported() || unexported {
+				switch {
+				case f.via != "":
+					funcs = append(funcs, f)
+				case f.union != "":
+					variants = append(variants, f)
+				default:
+					u.unmarshalField(src, dest, f)
 				}
 			}
 		}
 
+		// Discriminators have been decoded.
+		for _, f := range variants {
+			if f.selected(dest) {
+				u.unmarshalField(src, dest, f)
+			}
+		}
+
+		// Configs have been decoded.
+		for _, f := range funcs {
+			u.makeFuncField(dest, f)
+		}
+
 	case reflect.Array, reflect.Slice:
-		srcType := src.Type()
-		if srcType.Kind() != reflect.Slice {
-			panic(src) // TODO
+		if dest.Type().Elem().Kind() == reflect.Uint8 {
+			src = u.interned(src, dest.Type())
 		}
-		if srcType.Elem().Kind() != reflect.Interface {
-			panic(src) // TODO
+		if src.Kind() == reflect.String && dest.Type().Elem().Kind() == reflect.Uint8 {
+			unmarshalBytes(src.String(), dest)
+			break
+		}
+
+		if src.Kind() == reflect.Map && dest.Type().Elem().Kind() == reflect.Interface {
+			u.unmarshalHomogeneous(src, dest)
+			break
+		}
+
+		if !src.IsValid() && dest.Kind() == reflect.Slice {
+			dest.SetZero() // Nil object.
+			break
+		}
+		if src.Kind() != reflect.Slice {
+			pan.Panic(fmt.Errorf("unmarshal: expected slice for %s, got %s", dest.Type(), src.Kind()))
 		}
 
 		n := src.Len()
-		if dest.Kind() == reflect.Array && n != dest.Len() {
-			panic(src) // TODO
+		if dest.Kind() == reflect.Array {
+			n = u.arrayLength(n, dest)
 		}
 		if dest.Kind() == reflect.Slice {
-			dest.Set(reflect.MakeSlice(dest.Type(), n, n))
+			s := reflect.MakeSlice(dest.Type(), n, n)
+			if u.opts.Merge {
+				reflect.Copy(s, dest)
+			}
+			dest.Set(s)
 		}
 
 		for i := range n {
-			v := src.Index(i)
-			if !v.IsNil() {
-				u.unmarshal(v.Elem(), dest.Index(i))
+			if v := sourceElem(src.Index(i)); v.IsValid() {
+				u.path.pushIndex(i)
+				u.unmarshal(v, dest.Index(i))
+				u.path.pop()
+			} else {
+				dest.Index(i).SetZero()
 			}
 		}
 
@@ -99,109 +324,616 @@ func (u *unmarshaler) unmarshal(src, dest reflect.Value) {
 		keyType := destType.Key()
 		elemType := destType.Elem()
 
-		srcType := src.Type()
-		if srcType.Kind() != reflect.Map {
-			panic(src) // TODO
+		if src.Kind() == reflect.Slice {
+			u.unmarshalEntries(src, dest)
+			break
 		}
-		if srcType.Key().Kind() != keyType.Kind() {
-			panic(src) // TODO
+
+		if !src.IsValid() {
+			dest.SetZero() // Nil object.
+			break
 		}
-		if srcType.Elem().Kind() != reflect.Interface {
-			panic(src) // TODO
+		if src.Kind() != reflect.Map {
+			pan.Panic(fmt.Errorf("unmarshal: expected map for %s, got %s", destType, src.Kind()))
+		}
+		srcType := src.Type()
+		stringKeys := srcType.Key().Kind() == reflect.String && isIntegerKind(keyType.Kind())
+		textKeys := srcType.Key().Kind() == reflect.String && isTextKeyType(keyType)
+		structKeys := srcType.Key().Kind() == reflect.String && u.opts.StructMapKeys && isStructKeyType(keyType)
+		if srcType.Key().Kind() != keyType.Kind() && !stringKeys && !textKeys && !structKeys {
+			pan.Panic(fmt.Errorf("unmarshal: cannot unmarshal %s keys into %s", srcType.Key().Kind(), destType))
 		}
 
 		if !src.IsNil() {
-			dest.Set(reflect.MakeMapWithSize(destType, src.Len()))
+			if !u.opts.Merge || dest.IsNil() {
+				dest.Set(reflect.MakeMapWithSize(destType, src.Len()))
+			}
 
 			for iter := src.MapRange(); iter.Next(); {
-				v := iter.Value()
-				if v.IsZero() {
-					dest.SetMapIndex(iter.Key(), reflect.Zero(elemType))
+				key := iter.Key()
+				if stringKeys {
+					key = parseIntegerKey(key.String(), keyType)
+				} else if textKeys {
+					key = unmarshalTextKey(key.String(), keyType)
+				} else if structKeys {
+					key = u.unmarshalStructKey(key.String(), keyType)
+				} else if key.Type() != keyType {
+					key = key.Convert(keyType) // Named type.
+				}
+
+				v := sourceElem(iter.Value())
+				if !v.IsValid() {
+					dest.SetMapIndex(key, reflect.Zero(elemType))
 				} else {
 					tmp := reflect.New(elemType)
-					u.unmarshal(v.Elem(), tmp.Elem())
-					dest.SetMapIndex(iter.Key(), tmp.Elem())
+					if u.opts.Merge {
+						if old := dest.MapIndex(key); old.IsValid() {
+							tmp.Elem().Set(old)
+						}
+					}
+					u.path.pushKey(key)
+					u.unmarshal(v, tmp.Elem())
+					u.path.pop()
+					dest.SetMapIndex(key, tmp.Elem())
 				}
 			}
 		}
 
 	case reflect.Interface:
-		srcType := src.Type()
-		if srcType.Kind() != reflect.Map {
-			panic(src) // TODO
+		if u.opts.CaptureReaders && isCapturedReaderType(dest.Type()) && src.Kind() == reflect.String {
+			r, err := restoreReader(src.String())
+			if err != nil {
+				pan.Panic(fmt.Errorf("unmarshal: %s: %w", dest.Type(), err))
+			}
+			dest.Set(reflect.ValueOf(r))
+			break
+		}
+
+		if u.opts.UnwrapSingleImpl && dest.NumMethod() > 0 {
+			t, n, err := u.types.implementation(dest.Type())
+			if err != nil {
+				pan.Panic(err)
+			}
+
+			// Bare pointers are object indexes, so a map is a wrapper.
+			if n == 1 && !(t.Kind() == reflect.Pointer && u.isWrapper(src)) {
+				tmp := reflect.New(t)
+				u.unmarshal(src, tmp.Elem())
+				dest.Set(tmp.Elem())
+				break
+			}
+
+			if n > 1 && !u.isWrapper(src) {
+				pan.Panic(fmt.Errorf("unmarshal: %d registered types implement %s", n, dest.Type()))
+			}
+		}
+
+		if dest.NumMethod() == 0 && !u.isWrapper(src) {
+			if u.opts.RawUnknownTypes {
+				if name, x, ok := unwrap(src, u.opts.ExplicitWrappers); ok {
+					dest.Set(reflect.ValueOf(RawType{name, x}))
+					break
+				}
+			}
+
+			// Generic value without type information.
+			if src.IsValid() {
+				dest.Set(src)
+			}
+			break
+		}
+
+		if !src.IsValid() {
+			dest.SetZero() // Nil object.
+			break
+		}
+		if _, _, ok := unwrap(src, u.opts.ExplicitWrappers); !ok {
+			pan.Panic(fmt.Errorf("unmarshal: expected type-name wrapper for %s, got %s", dest.Type(), src.Kind()))
+		}
+		v := retype(u.unmarshalWrapped(src), dest.Type())
+		if !v.Type().AssignableTo(dest.Type()) {
+			name, _, _ := unwrap(src, u.opts.ExplicitWrappers)
+			pan.Panic(fmt.Errorf("unmarshal: type %q is %s, which doesn't implement %s", name, v.Type(), dest.Type()))
 		}
-		if srcType.Key().Kind() != reflect.String {
-			panic(src) // TODO
+		dest.Set(v)
+
+	case reflect.Pointer:
+		if src.Kind() == reflect.Interface && src.IsNil() {
+			dest.SetZero()
+			break
 		}
-		if srcType.Elem().Kind() != reflect.Interface {
-			panic(src) // TODO
+
+		index := u.objectIndex(src, dest.Type())
+
+		if x := u.objects[index]; x != nil {
+			v := reflect.ValueOf(x)
+			if !v.Type().AssignableTo(dest.Type()) {
+				pan.Panic(fmt.Errorf("unmarshal: object %d is %s, not %s", index, v.Type(), dest.Type()))
+			}
+			dest.Set(v)
+			return
 		}
-		if src.Len() != 1 {
-			panic(src) // TODO
+
+		ptr := reflect.New(dest.Type().Elem())
+		u.objects[index] = ptr.Interface()
+		dest.Set(ptr)
+		u.unmarshal(reflect.ValueOf(u.sources[index]), ptr.Elem())
+
+	case reflect.Chan:
+		if !u.opts.SnapshotChannels || dest.Type().ChanDir() != reflect.BothDir {
+			pan.Panic(fmt.Errorf("unmarshal: target %w", &UnsupportedTypeError{dest.Type()}))
+		}
+
+		elems := reflect.New(reflect.SliceOf(dest.Type().Elem())).Elem()
+		u.unmarshal(src, elems)
+
+		ch := reflect.MakeChan(dest.Type(), elems.Len())
+		for i := range elems.Len() {
+			ch.Send(elems.Index(i))
 		}
+		dest.Set(ch)
 
-		iter := src.MapRange()
-		iter.Next()
+	default:
+		pan.Panic(fmt.Errorf("unmarshal: target %w", &UnsupportedTypeError{dest.Type()}))
+	}
+
+	switch dest.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		// Hooks are invoked for the referenced value.
+	default:
+		afterUnmarshal(dest)
+	}
+}
 
-		typeName := iter.Key().String()
-		t, found := u.types.nameTypes[typeName]
-		if !found {
-			pan.Panic(fmt.Errorf("unmarshal: type name not registered: %q", typeName))
+func (u *unmarshaler) unmarshalField(src, dest reflect.Value, f field) {
+	v := src.MapIndex(reflect.ValueOf(f.name))
+	if v == (reflect.Value{}) {
+		if f.required {
+			pan.Panic(fmt.Errorf("unmarshal: %s: required field missing: %s", dest.Type(), f.name))
 		}
+		return
+	}
+
+	field, err := fieldByIndexAlloc(dest, f.Index)
+	if err != nil {
+		pan.Panic(fmt.Errorf("unmarshal: %s: %w", dest.Type(), err))
+	}
+	if !field.CanSet() {
+		field = unsafeField(field)
+	}
+
+	u.path.pushField(f.name)
+
+	if f.transform {
+		v = u.untransformField(f, v)
+	}
+
+	if v.IsNil() {
+		field.SetZero() // Explicit null.
+	} else {
+		u.unmarshal(v.Elem(), field)
+	}
+
+	u.path.pop()
+}
+
+// objectIndex parses a reference to an object.
+func (u *unmarshaler) objectIndex(src reflect.Value, dest reflect.Type) uint64 {
+	var index uint64
 
+	switch src.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		index = src.Uint()
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := src.Int()
+		if i < 0 {
+			pan.Panic(fmt.Errorf("unmarshal: negative object index: %d", i))
+		}
+		index = uint64(i)
+
+	case reflect.Float32, reflect.Float64:
+		f := src.Float()
+		index = uint64(f)
+		if f < 0 || f != float64(index) {
+			pan.Panic(fmt.Errorf("unmarshal: invalid object index: %v", f))
+		}
+
+	case reflect.String:
+		i, err := strconv.ParseUint(src.String(), 0, 64)
+		if err != nil {
+			pan.Panic(fmt.Errorf("unmarshal: invalid object index: %q", src.String()))
+		}
+		index = i
+
+	default:
+		pan.Panic(fmt.Errorf("unmarshal: expected object index for %s, got %s", dest, src.Kind()))
+	}
+
+	if index >= uint64(len(u.objects)) {
+		pan.Panic(fmt.Errorf("unmarshal: %w", &IndexError{int(min(index, math.MaxInt)), len(u.objects)}))
+	}
+	return index
+}
+
+// interned resolves a numeric source to the string object it references, if
+// values are interned.
+func (u *unmarshaler) interned(src reflect.Value, dest reflect.Type) reflect.Value {
+	if !u.opts.InternValues || !isNumberKind(src.Kind()) {
+		return src
+	}
+
+	index := u.objectIndex(src, dest)
+	s, ok := u.sources[index].(string)
+	if !ok {
+		pan.Panic(fmt.Errorf("unmarshal: object %d is not a string for %s", index, dest))
+	}
+	if u.objects[index] == nil {
+		u.objects[index] = s // Reached.
+	}
+	return reflect.ValueOf(s)
+}
+
+func (u *unmarshaler) untransformField(f field, v reflect.Value) reflect.Value {
+	if u.opts.Untransform == nil {
+		pan.Panic(errors.New("unmarshal: no untransform for encrypted field"))
+	}
+
+	x, err := u.opts.Untransform(u.path.String(), f.tag, v.Interface())
+	if err != nil {
+		pan.Panic(fmt.Errorf("unmarshal: %w", err))
+	}
+	return reflect.ValueOf(&x).Elem()
+}
+
+func (u *unmarshaler) makeFuncField(dest reflect.Value, f field) {
+	config, err := fieldByIndexAlloc(dest, f.viaIndex)
+	if err != nil {
+		pan.Panic(fmt.Errorf("unmarshal: %s: %w", dest.Type(), err))
+	}
+
+	factory, found := u.types.funcFactory(config.Type(), f.Type)
+	if !found {
+		pan.Panic(fmt.Errorf("unmarshal: %s.%s: no function factory registered for %s -> %s", dest.Type(), f.Name, config.Type(), f.Type))
+	}
+
+	field, err := fieldByIndexAlloc(dest, f.Index)
+	if err != nil {
+		pan.Panic(fmt.Errorf("unmarshal: %s: %w", dest.Type(), err))
+	}
+	if !field.CanSet() {
+		field = unsafeField(field)
+	}
+	if !config.CanInterface() {
+		config = unsafeField(config)
+	}
+
+	field.Set(factory.Call([]reflect.Value{config})[0])
+}
+
+// unmarshalHomogeneous decodes an interface slice or array whose elements are
+// wrapped with a single type name.
+func (u *unmarshaler) unmarshalHomogeneous(src, dest reflect.Value) {
+	typeName, x, ok := unwrap(src, u.opts.ExplicitWrappers)
+	if !ok {
+		pan.Panic(fmt.Errorf("unmarshal: invalid source for %s: %s", dest.Type(), src.Kind()))
+	}
+	elems, ok := x.([]any)
+	if !ok {
+		pan.Panic(fmt.Errorf("unmarshal: invalid source for %s: %s", dest.Type(), reflect.TypeOf(x)))
+	}
+
+	t, found, err := u.types.typeFor(typeName)
+	if err != nil {
+		pan.Panic(err)
+	}
+	if !found {
+		pan.Panic(fmt.Errorf("unmarshal: %w", &UnregisteredTypeError{Name: typeName}))
+	}
+	if !t.AssignableTo(dest.Type().Elem()) {
+		pan.Panic(fmt.Errorf("unmarshal: %s is not assignable to %s", t, dest.Type().Elem()))
+	}
+
+	n := len(elems)
+	if dest.Kind() == reflect.Array {
+		n = u.arrayLength(n, dest)
+		elems = elems[:n]
+	}
+	if dest.Kind() == reflect.Slice {
+		dest.Set(reflect.MakeSlice(dest.Type(), n, n))
+	}
+
+	for i, x := range elems {
 		tmp := reflect.New(t)
-		u.unmarshal(iter.Value().Elem(), tmp.Elem())
-		dest.Set(tmp.Elem())
+		if x != nil {
+			u.path.pushIndex(i)
+			u.unmarshal(reflect.ValueOf(x), tmp.Elem())
+			u.path.pop()
+		}
+		dest.Index(i).Set(tmp.Elem())
+	}
+}
 
-	case reflect.Pointer:
-		var index uint64
+// arrayLength checks the source length n for an array destination, and returns
+// the number of elements to decode.  The remainder of a padded array is
+// zeroed.
+func (u *unmarshaler) arrayLength(n int, dest reflect.Value) int {
+	switch l := dest.Len(); {
+	case n == l:
+		return n
+
+	case n < l && u.opts.PadShortArrays:
+		for i := n; i < l; i++ {
+			dest.Index(i).SetZero()
+		}
+		return n
 
-		switch src.Kind() {
-		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-			index = src.Uint()
+	case n > l && u.opts.TruncateLongArrays:
+		return l
 
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			i := src.Int()
-			if i < 0 {
-				panic(src) // TODO
+	default:
+		pan.Panic(fmt.Errorf("unmarshal: array %s expects %d elements, source has %d", dest.Type(), l, n))
+		return 0
+	}
+}
+
+// unmarshalEntries decodes a map from a list of key-value pairs.  See
+// Options.MapAsEntries.
+func (u *unmarshaler) unmarshalEntries(src, dest reflect.Value) {
+	entries, ok := src.Interface().([]any)
+	if !ok {
+		pan.Panic(fmt.Errorf("unmarshal: expected map entries for %s, got %s", dest.Type(), src.Type()))
+	}
+
+	t := dest.Type()
+	if !u.opts.Merge || dest.IsNil() {
+		dest.Set(reflect.MakeMapWithSize(t, len(entries)))
+	}
+
+	for i, x := range entries {
+		u.path.pushIndex(i)
+
+		entry, ok := x.([]any)
+		if !ok || len(entry) != 2 || entry[0] == nil {
+			pan.Panic(fmt.Errorf("unmarshal: invalid map entry for %s: %v", t, x))
+		}
+
+		var key reflect.Value
+		if s, ok := entry[0].(string); ok && u.opts.StructMapKeys && isStructKeyType(t.Key()) {
+			key = u.unmarshalStructKey(s, t.Key())
+		} else {
+			key = reflect.New(t.Key()).Elem()
+			u.unmarshal(reflect.ValueOf(entry[0]), key)
+		}
+
+		elem := reflect.New(t.Elem()).Elem()
+		if entry[1] != nil {
+			if u.opts.Merge {
+				if old := dest.MapIndex(key); old.IsValid() {
+					elem.Set(old)
+				}
 			}
-			index = uint64(i)
+			u.unmarshal(reflect.ValueOf(entry[1]), elem)
+		}
+
+		dest.SetMapIndex(key, elem)
+		u.path.pop()
+	}
+}
+
+// sourceElem returns the value of a slice element or a map value of a source
+// object.  Elements are usually held by interfaces, but hand-built sources may
+// also have concrete element types.  The result is invalid if the element is a
+// nil interface.
+func sourceElem(v reflect.Value) reflect.Value {
+	if v.Kind() == reflect.Interface {
+		return v.Elem()
+	}
+	return v
+}
+
+// checkUnknownFields panics if the source map of a struct has a key which
+// doesn't name a decodable field.
+func (u *unmarshaler) checkUnknownFields(src reflect.Value, t reflect.Type, fields []field, unexported bool) {
+	for iter := src.MapRange(); iter.Next(); {
+		name := iter.Key().String()
+		if !slices.ContainsFunc(fields, func(f field) bool {
+			return f.name == name && (f.IsExported() || unexported) && f.via == ""
+		}) {
+			pan.Panic(fmt.Errorf("unmarshal: unknown field %q in %s", name, t))
+		}
+	}
+}
 
+// parseIntegerKey parses a map key which has been converted to a string, as
+// encoding/json does.
+func parseIntegerKey(s string, t reflect.Type) reflect.Value {
+	key := reflect.New(t).Elem()
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			pan.Panic(fmt.Errorf("unmarshal: invalid %s map key: %q", t, s))
+		}
+		key.SetInt(i)
+
+	default:
+		i, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			pan.Panic(fmt.Errorf("unmarshal: invalid %s map key: %q", t, s))
+		}
+		key.SetUint(i)
+	}
+
+	return key
+}
+
+// unmarshalComplex decodes a [real, imag] pair.  See Options.ComplexPairs.
+func unmarshalComplex(src, dest reflect.Value) {
+	pair, ok := src.Interface().([]any)
+	if !ok || len(pair) != 2 {
+		pan.Panic(fmt.Errorf("unmarshal: expected [real, imag] pair for %s, got %v", dest.Type(), src))
+	}
+
+	var parts [2]float64
+
+	for i, x := range pair {
+		v := reflect.ValueOf(x)
+		if !isNumberKind(v.Kind()) {
+			pan.Panic(fmt.Errorf("unmarshal: expected [real, imag] pair for %s, got %v", dest.Type(), src))
+		}
+		coerceNumber(v, reflect.ValueOf(&parts[i]).Elem())
+	}
+
+	dest.SetComplex(complex(parts[0], parts[1]))
+}
+
+// coerceNumber sets an integer or floating-point destination from a source of
+// a different numeric kind, such as float64 produced by encoding/json.  Lossy
+// conversions are rejected.
+func coerceNumber(src, dest reflect.Value) {
+	ok := true
+
+	switch dest.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+
+		switch src.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			i = src.Int()
 		case reflect.Float32, reflect.Float64:
 			f := src.Float()
-			index = uint64(f)
-			if f < 0 || f != float64(index) {
-				panic(src) // TODO
-			}
+			ok = f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64
+			i = int64(f)
+		default:
+			ok = src.Uint() <= math.MaxInt64
+			i = int64(src.Uint())
+		}
 
-		case reflect.String:
-			index = Must(strconv.ParseUint(src.String(), 0, 64))
+		if ok = ok && !dest.OverflowInt(i); ok {
+			dest.SetInt(i)
+		}
 
-		case reflect.Interface:
-			if src.IsNil() {
-				dest.Set(src)
-				break
-			}
-			fallthrough
+	case reflect.Float32, reflect.Float64:
+		var f float64
+
+		switch src.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			f = float64(src.Int())
+		case reflect.Float32, reflect.Float64:
+			f = src.Float()
 		default:
-			panic(src) // TODO
+			f = float64(src.Uint())
 		}
 
-		if index >= uint64(len(u.objects)) {
-			panic(src) // TODO
+		if ok = !dest.OverflowFloat(f); ok {
+			dest.SetFloat(f)
 		}
 
-		if x := u.objects[index]; x != nil {
-			dest.Set(reflect.ValueOf(x))
-			return
+	default: // Unsigned
+		var i uint64
+
+		switch src.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			ok = src.Int() >= 0
+			i = uint64(src.Int())
+		case reflect.Float32, reflect.Float64:
+			f := src.Float()
+			ok = f == math.Trunc(f) && f >= 0 && f < math.MaxUint64
+			i = uint64(f)
+		default:
+			i = src.Uint()
 		}
 
-		ptr := reflect.New(dest.Type().Elem())
-		u.objects[index] = ptr.Interface()
-		dest.Set(ptr)
-		u.unmarshal(reflect.ValueOf(u.sources[index]), ptr.Elem())
+		if ok = ok && !dest.OverflowUint(i); ok {
+			dest.SetUint(i)
+		}
+	}
 
+	if !ok {
+		pan.Panic(fmt.Errorf("unmarshal: %s value %v does not fit in %s", src.Kind(), src, dest.Type()))
+	}
+}
+
+func isNumberKind(k reflect.Kind) bool {
+	return isIntegerKind(k) || k == reflect.Float32 || k == reflect.Float64
+}
+
+func isIntegerKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
 	default:
-		pan.Panic(fmt.Errorf("unmarshal: target type not supported: %s", dest.Type()))
+		return false
+	}
+}
+
+// isWrapper checks if src is a type-name wrapper with a registered name.
+func (u *unmarshaler) isWrapper(src reflect.Value) bool {
+	name, _, ok := unwrap(src, u.opts.ExplicitWrappers)
+	if !ok {
+		return false
+	}
+
+	if _, found, _ := u.types.typeFor(name); found {
+		return true
+	}
+	return u.types.codecByName(name) != nil
+}
+
+// RawType holds a value whose type name is not registered.  See
+// Options.RawUnknownTypes.
+type RawType struct {
+	Name  string
+	Value any // Generic value.
+}
+
+// retype returns a pointer to a copy of v if v is not assignable to type t but
+// the pointer is.  (A pointer type's method set includes the value methods, so
+// the reverse is not needed.)
+func retype(v reflect.Value, t reflect.Type) reflect.Value {
+	if vt := v.Type(); !vt.AssignableTo(t) && reflect.PointerTo(vt).AssignableTo(t) {
+		p := reflect.New(vt)
+		p.Elem().Set(v)
+		return p
+	}
+	return v
+}
+
+// unmarshalWrapped decodes a value of a registered type from a type-name
+// wrapper.
+func (u *unmarshaler) unmarshalWrapped(src reflect.Value) reflect.Value {
+	typeName, x, ok := unwrap(src, u.opts.ExplicitWrappers)
+	if !ok {
+		pan.Panic(fmt.Errorf("unmarshal: expected type-name wrapper, got %s", src.Kind()))
+	}
+
+	t, found, err := u.types.typeFor(typeName)
+	if err != nil {
+		pan.Panic(err)
+	}
+	if !found {
+		c := u.types.codecByName(typeName)
+		if c == nil {
+			pan.Panic(fmt.Errorf("unmarshal: %w", &UnregisteredTypeError{Name: typeName}))
+		}
+
+		repr := reflect.New(c.repr)
+		if x != nil {
+			u.unmarshal(reflect.ValueOf(x), repr.Elem())
+		}
+
+		v, err := c.decode(repr.Elem())
+		if err != nil {
+			pan.Panic(fmt.Errorf("unmarshal: %s: %w", c.t, err))
+		}
+		return v
+	}
+
+	tmp := reflect.New(t)
+	if x != nil { // Nil for nil pointers and such.
+		u.unmarshal(reflect.ValueOf(x), tmp.Elem())
 	}
+	return tmp.Elem()
 }
@@ -0,0 +1,1580 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type money struct {
+	amount   int64
+	currency string
+}
+
+func (m money) Amount() int64    { return m.amount }
+func (m money) Currency() string { return m.currency }
+
+type account struct {
+	Balance money
+	Secret  secret
+}
+
+type secret struct {
+	Public  string
+	private string
+}
+
+func TestUnexportedAllowed(t *testing.T) {
+	types := NewTypes()
+	if err := types.AllowUnexported(money{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := types.AllowUnexported(&money{}); err == nil {
+		t.Error("pointer type was accepted")
+	}
+
+	x := &account{
+		money{12345, "EUR"},
+		secret{"public", "private"},
+	}
+
+	objects, err := Marshal(x, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	if _, found := objects[0].(map[string]any)["Secret"].(map[string]any)["private"]; found {
+		t.Error("unexported field of non-allowed type was marshaled")
+	}
+
+	y := new(account)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	if y.Balance.Amount() != 12345 || y.Balance.Currency() != "EUR" {
+		t.Errorf("balance: %#v", y.Balance)
+	}
+	if !reflect.DeepEqual(y.Secret, secret{Public: "public"}) {
+		t.Errorf("secret: %#v", y.Secret)
+	}
+
+	// Unexported fields must not be written for non-allowed types even
+	// if the source contains them.
+	objects[0].(map[string]any)["Secret"].(map[string]any)["private"] = "injected"
+
+	z := new(account)
+	if err := Unmarshal(objects, z, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if z.Secret.private != "" {
+		t.Error("unexported field of non-allowed type was unmarshaled")
+	}
+}
+
+func TestUnexportedAllowedInterface(t *testing.T) {
+	types := NewTypes().MustRegister(TypeName(money{}))
+	if err := types.AllowUnexported(money{}); err != nil {
+		t.Fatal(err)
+	}
+
+	type wallet struct {
+		Value any
+	}
+
+	x := &wallet{money{100, "USD"}}
+
+	objects, err := Marshal(x, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	y := new(wallet)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+}
+
+func TestUnmarshalPointerChain(t *testing.T) {
+	type level3 struct {
+		C int
+		D string
+	}
+
+	type level2 struct {
+		B *level3
+		X int
+	}
+
+	type level1 struct {
+		A *level2
+		Y string
+	}
+
+	sources := []any{
+		map[string]any{"A": 1},
+		map[string]any{"B": 2},
+		map[string]any{"C": 5},
+	}
+
+	x := &level1{Y: "preset"}
+	if err := Unmarshal(sources, x, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	expect := &level1{&level2{&level3{C: 5}, 0}, "preset"}
+	if !reflect.DeepEqual(x, expect) {
+		t.Errorf("mismatch:\nx: %#v\nexpect: %#v", x, expect)
+	}
+}
+
+type (
+	ids   []uint32
+	temp  float64
+	temps []temp
+	pair  [2]temp
+)
+
+func TestUnmarshalNamedSlices(t *testing.T) {
+	type readings struct {
+		IDs   ids
+		Temps temps
+		Pair  pair
+	}
+
+	sources := []any{
+		map[string]any{
+			"IDs":   []any{uint32(1), uint32(2)},
+			"Temps": []any{20.5, -3.0},
+			"Pair":  []any{1.0, 2.0},
+		},
+	}
+
+	x := new(readings)
+	if err := Unmarshal(sources, x, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	expect := &readings{ids{1, 2}, temps{20.5, -3}, pair{1, 2}}
+	if !reflect.DeepEqual(x, expect) {
+		t.Errorf("mismatch:\nx: %#v\nexpect: %#v", x, expect)
+	}
+
+	objects, err := Marshal(expect, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	y := new(readings)
+	if err := Unmarshal(objects, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	if !reflect.DeepEqual(y, expect) {
+		t.Errorf("mismatch:\ny: %#v\nexpect: %#v", y, expect)
+	}
+}
+
+func TestUnmarshalGenericInterface(t *testing.T) {
+	types := NewTypes().MustRegister(TypeName(alt1{}))
+
+	type blob struct {
+		Props map[string]any
+		List  []any
+		Value any
+		Typed any
+		Nil   any
+	}
+
+	x := &blob{
+		Props: map[string]any{
+			"name":   "thing",
+			"count":  3,
+			"nested": map[string]any{"ok": true},
+			"list":   []any{1.5, "two"},
+		},
+		List:  []any{"a", 1, nil, map[string]any{"b": false}},
+		Value: "scalar",
+		Typed: alt1{"typed"},
+	}
+
+	objects, err := Marshal(x, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	y := new(blob)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+
+	type point struct {
+		X int
+	}
+	type code int
+
+	for _, value := range []any{&point{7}, point{7}, code(7), []int{7}} {
+		_, err := Marshal(&blob{Value: value}, types, false)
+		var unregistered *UnregisteredTypeError
+		if !errors.As(err, &unregistered) {
+			t.Errorf("unregistered %T in empty interface: %v", value, err)
+		}
+	}
+
+	sources := []any{
+		map[string]any{
+			"Props": map[string]any{"schemaless": map[string]any{"x": []any{1.0}}},
+			"List":  []any{map[string]any{"one": 1.0}},
+		},
+	}
+
+	z := new(blob)
+	if err := Unmarshal(sources, z, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	expect := &blob{
+		Props: map[string]any{"schemaless": map[string]any{"x": []any{1.0}}},
+		List:  []any{map[string]any{"one": 1.0}},
+	}
+	if !reflect.DeepEqual(z, expect) {
+		t.Errorf("mismatch:\nz: %#v\nexpect: %#v", z, expect)
+	}
+}
+
+func TestUnmarshalRequired(t *testing.T) {
+	type settings struct {
+		Host string `marshal:",required"`
+		Port int    `marshal:",required"`
+		Mode string
+	}
+
+	x := new(settings)
+	sources := []any{map[string]any{"Host": "localhost", "Port": 80}}
+	if err := Unmarshal(sources, x, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if *x != (settings{"localhost", 80, ""}) {
+		t.Errorf("unmarshaled: %#v", x)
+	}
+
+	sources = []any{map[string]any{"Host": "localhost", "Mode": "fast"}}
+	err := Unmarshal(sources, new(settings), NewTypes())
+	if err == nil || !strings.Contains(err.Error(), "required field missing: Port") {
+		t.Error("missing field error:", err)
+	}
+}
+
+type Inner struct {
+	A int
+	B string
+}
+
+type innerHidden struct {
+	C int
+}
+
+func TestUnmarshalEmbedded(t *testing.T) {
+	type outer struct {
+		Inner
+		X int
+	}
+
+	type outerPtr struct {
+		*Inner
+		X int
+	}
+
+	type outerHidden struct {
+		*innerHidden
+	}
+
+	sources := []any{map[string]any{"A": 1, "B": "b", "X": 2}}
+
+	x := new(outer)
+	if err := Unmarshal(sources, x, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if *x != (outer{Inner{1, "b"}, 2}) {
+		t.Errorf("unmarshaled: %#v", x)
+	}
+
+	y := new(outerPtr)
+	if err := Unmarshal(sources, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if y.Inner == nil || *y.Inner != (Inner{1, "b"}) || y.X != 2 {
+		t.Errorf("unmarshaled: %#v", y)
+	}
+
+	objects, err := Marshal(&outerPtr{X: 3}, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if !reflect.DeepEqual(objects, []any{map[string]any{"X": 3}}) {
+		t.Errorf("marshaled: %#v", objects)
+	}
+
+	sources = []any{map[string]any{"C": 1}}
+	if err := Unmarshal(sources, new(outerHidden), NewTypes()); err == nil {
+		t.Error("embedded pointer to unexported struct was allocated")
+	}
+}
+
+func TestUnmarshalStructEvolution(t *testing.T) {
+	type userV1 struct {
+		ID       int
+		Name     string
+		Nickname string
+		Friends  []*userV1
+	}
+
+	type userV2 struct {
+		Friends []*userV2
+		Email   string
+		Name    string
+		ID      int
+	}
+
+	alice := &userV1{ID: 1, Name: "Alice", Nickname: "al"}
+	bob := &userV1{ID: 2, Name: "Bob", Friends: []*userV1{alice}}
+	alice.Friends = []*userV1{bob}
+
+	objects, err := Marshal(alice, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	x := &userV2{Email: "preset@example.net"}
+	if err := Unmarshal(objects, x, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	if x.ID != 1 || x.Name != "Alice" || x.Email != "preset@example.net" {
+		t.Errorf("unmarshaled: %#v", x)
+	}
+	if len(x.Friends) != 1 || x.Friends[0].Name != "Bob" || x.Friends[0].Email != "" || x.Friends[0].Friends[0] != x {
+		t.Errorf("friends: %#v", x.Friends)
+	}
+
+	// Backward: decode the newer layout into the older one.
+	objects, err = Marshal(x, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	y := new(userV1)
+	if err := Unmarshal(objects, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if y.ID != 1 || y.Name != "Alice" || y.Nickname != "" || y.Friends[0].Friends[0] != y {
+		t.Errorf("unmarshaled: %#v", y)
+	}
+}
+
+func TestUnmarshalStringMapKeys(t *testing.T) {
+	type table struct {
+		Names  map[int]string
+		Bytes  map[uint8]string
+		Labels map[string]string
+	}
+
+	x := &table{
+		Names:  map[int]string{-1: "minus one", 0: "zero", 10: "ten"},
+		Bytes:  map[uint8]string{255: "max"},
+		Labels: map[string]string{"10": "string"},
+	}
+
+	objects, err := Marshal(x, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	data, err := json.Marshal(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sources []any
+	if err := json.Unmarshal(data, &sources); err != nil {
+		t.Fatal(err)
+	}
+
+	y := new(table)
+	if err := Unmarshal(sources, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+
+	for _, key := range []string{"x", "1.5", "256"} {
+		sources := []any{map[string]any{"Bytes": map[string]any{key: "invalid"}}}
+		if err := Unmarshal(sources, new(table), NewTypes()); err == nil {
+			t.Errorf("key %q was accepted", key)
+		}
+	}
+}
+
+func TestUnmarshalRequireAllReachable(t *testing.T) {
+	type node struct {
+		Value int
+		Next  *node
+	}
+
+	opts := Options{RequireAllReachable: true}
+
+	sources := []any{
+		map[string]any{"Value": 1, "Next": 1},
+		map[string]any{"Value": 2, "Next": 0},
+	}
+	if err := UnmarshalOptions(sources, new(node), NewTypes(), opts); err != nil {
+		t.Error("unmarshal error:", err)
+	}
+
+	sources = append(sources, map[string]any{"Value": 3}, "padding")
+
+	if err := Unmarshal(sources, new(node), NewTypes()); err != nil {
+		t.Error("unmarshal error without option:", err)
+	}
+
+	err := UnmarshalOptions(sources, new(node), NewTypes(), opts)
+	if err == nil || !strings.Contains(err.Error(), "[2 3]") {
+		t.Error("orphan error:", err)
+	}
+}
+
+type counter struct {
+	sync.Mutex
+	mu    sync.RWMutex
+	Once  sync.Once
+	Wait  sync.WaitGroup
+	Count int
+}
+
+func TestSyncFields(t *testing.T) {
+	types := NewTypes()
+	if err := types.AllowUnexported(counter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	x := &counter{Count: 3}
+	x.Lock()
+	x.mu.RLock()
+	x.Once.Do(func() {})
+	x.Wait.Add(1)
+
+	objects, err := Marshal(x, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if !reflect.DeepEqual(objects[0], map[string]any{"Count": 3}) {
+		t.Errorf("marshaled: %#v", objects[0])
+	}
+
+	y := new(counter)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if y.Count != 3 || !y.TryLock() || !y.mu.TryLock() {
+		t.Error("bad state")
+	}
+}
+
+func TestScalarConverters(t *testing.T) {
+	type flags struct {
+		Enabled bool
+		Debug   bool
+		Level   int
+	}
+
+	opts := Options{
+		ScalarConverters: map[reflect.Kind]func(any) (any, bool){
+			reflect.Bool: func(x any) (any, bool) {
+				switch x {
+				case "yes":
+					return true, true
+				case "no":
+					return false, true
+				}
+				return nil, false
+			},
+			reflect.Int: func(x any) (any, bool) {
+				if b, ok := x.(bool); ok && b {
+					return 1, true
+				} else if ok {
+					return 0, true
+				}
+				return nil, false
+			},
+		},
+	}
+
+	sources := []any{map[string]any{"Enabled": "yes", "Debug": "no", "Level": 2.0}}
+
+	x := &flags{Debug: true}
+	if err := UnmarshalOptions(sources, x, NewTypes(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if *x != (flags{true, false, 2}) {
+		t.Errorf("%#v", x)
+	}
+
+	sources = []any{map[string]any{"Level": true}}
+
+	if err := UnmarshalOptions(sources, x, NewTypes(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if x.Level != 1 {
+		t.Errorf("level: %d", x.Level)
+	}
+
+	sources = []any{map[string]any{"Enabled": "maybe"}}
+
+	if err := UnmarshalOptions(sources, new(flags), NewTypes(), opts); err == nil {
+		t.Error("unconvertible value accepted")
+	}
+}
+
+func TestRetypePointer(t *testing.T) {
+	type stored struct {
+		Value any
+	}
+	type loaded struct {
+		Value alt
+	}
+
+	types := NewTypes().MustRegister(
+		TypeName(alt1{}),
+		TypeName(alt2{}),
+		Type("alt1ptr", &alt1{}),
+	)
+
+	for _, x := range []any{alt1{"value"}, alt2{"value"}, &alt1{"pointer"}} {
+		objects, err := Marshal(&stored{x}, types, false)
+		if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+
+		y := new(loaded)
+		if err := Unmarshal(objects, y, types); err != nil {
+			t.Fatal("unmarshal error:", err)
+		}
+
+		expect := x
+		if v, ok := x.(alt2); ok {
+			expect = &v // Only the pointer implements alt.
+		}
+		if !reflect.DeepEqual(y.Value, expect) {
+			t.Errorf("mismatch:\nx: %#v\ny: %#v", expect, y.Value)
+		}
+	}
+}
+
+func TestMixedPointerSlice(t *testing.T) {
+	type item struct {
+		Name string
+	}
+	type list struct {
+		Items []*item
+		First *item
+	}
+
+	shared := &item{"shared"}
+	x := &list{
+		Items: []*item{shared, &item{"unique"}, nil, shared},
+		First: shared,
+	}
+
+	objects, err := Marshal(x, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	// Sources may also use float64 indexes (JSON) and explicit nils.
+	root := objects[0].(map[string]any)
+	items := root["Items"].([]any)
+	items[0] = float64(items[0].(int))
+
+	y := new(list)
+	if err := Unmarshal(objects, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	if len(y.Items) != 4 || y.Items[2] != nil {
+		t.Fatalf("items: %#v", y.Items)
+	}
+	if y.Items[0] != y.Items[3] || y.Items[0] != y.First || y.Items[1] == y.First {
+		t.Error("sharing was not preserved")
+	}
+	if y.Items[0].Name != "shared" || y.Items[1].Name != "unique" {
+		t.Errorf("items: %#v %#v", y.Items[0], y.Items[1])
+	}
+}
+
+func TestTagKey(t *testing.T) {
+	type record struct {
+		ID   int `codec:",required"`
+		Name string
+	}
+
+	opts := Options{TagKey: "codec"}
+
+	objects, err := MarshalOptions(&record{1, "name"}, NewTypes(), opts)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	sources := []any{map[string]any{"Name": "name"}}
+
+	if err := UnmarshalOptions(sources, new(record), NewTypes(), opts); err == nil {
+		t.Error("required field was not enforced")
+	}
+	if err := Unmarshal(sources, new(record), NewTypes()); err != nil {
+		t.Error("default tag key:", err)
+	}
+
+	y := new(record)
+	if err := UnmarshalOptions(objects, y, NewTypes(), opts); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if *y != (record{1, "name"}) {
+		t.Errorf("%#v", y)
+	}
+}
+
+func TestUnmarshalStructMismatch(t *testing.T) {
+	type record struct {
+		Inner Inner
+	}
+
+	for _, src := range []any{
+		"string",
+		[]any{1, 2},
+		map[int]any{1: 2},
+		map[string]int{"X": 1},
+	} {
+		sources := []any{map[string]any{"Inner": src}}
+
+		err := Unmarshal(sources, new(record), NewTypes())
+		if err == nil {
+			t.Errorf("%T: no error", src)
+		} else if !strings.Contains(err.Error(), "for struct marshal.Inner") {
+			t.Errorf("%T: %v", src, err)
+		}
+	}
+}
+
+func TestUnmarshalScalarMismatch(t *testing.T) {
+	type record struct {
+		Count int
+	}
+
+	sources := []any{map[string]any{"Count": "three"}}
+
+	err := Unmarshal(sources, new(record), NewTypes())
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if s := err.Error(); !strings.Contains(s, "string") || !strings.Contains(s, "int") {
+		t.Error(err)
+	}
+}
+
+func TestUnmarshalJSONNumbers(t *testing.T) {
+	types := NewTypes().MustRegister(
+		TypeName(alt1{}),
+		Type("alt2ptr", &alt2{}),
+	)
+
+	x := newTopLevel(types)
+
+	objects, err := Marshal(x, types, true)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	data, err := json.Marshal(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sources []any
+	if err := json.Unmarshal(data, &sources); err != nil {
+		t.Fatal(err)
+	}
+
+	y := new(topLevel)
+	if err := Unmarshal(sources, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	x.UnsupportedMap = nil
+	x.UnsupportedFunc = nil
+	x.UnsupportedChan = nil
+	x.UnsupportedUnsafe = nil
+	if !SharingEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+}
+
+func TestCoerceNumber(t *testing.T) {
+	type numbers struct {
+		Int8    int8
+		Uint    uint
+		Float32 float32
+	}
+
+	y := new(numbers)
+	sources := []any{map[string]any{"Int8": -128.0, "Uint": 7.0, "Float32": 3}}
+	if err := Unmarshal(sources, y, NewTypes()); err != nil {
+		t.Fatal(err)
+	}
+	if *y != (numbers{-128, 7, 3}) {
+		t.Errorf("%#v", y)
+	}
+
+	for _, src := range []map[string]any{
+		{"Int8": 1.5},
+		{"Int8": 128.0},
+		{"Int8": uint64(200)},
+		{"Uint": -1.0},
+		{"Uint": -1},
+		{"Float32": 1e300},
+	} {
+		if err := Unmarshal([]any{src}, new(numbers), NewTypes()); err == nil {
+			t.Errorf("%v: no error", src)
+		}
+	}
+}
+
+func TestFieldNames(t *testing.T) {
+	type embedded struct {
+		Hidden int
+	}
+	type record struct {
+		embedded `marshal:"-"`
+		ID       int    `marshal:"id,required"`
+		Name     string `marshal:"display_name"`
+		Cache    []byte `marshal:"-"`
+		Dash     int    `marshal:"-,"`
+	}
+
+	types := NewTypes()
+	if err := types.AllowUnexported(record{}); err != nil {
+		t.Fatal(err)
+	}
+
+	x := &record{embedded{1}, 2, "name", []byte("cached"), 3}
+
+	objects, err := Marshal(x, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	expect := map[string]any{"id": 2, "display_name": "name", "-": 3}
+	if !reflect.DeepEqual(objects[0], expect) {
+		t.Errorf("marshaled: %#v", objects[0])
+	}
+
+	objects[0].(map[string]any)["Cache"] = []any{"ignored"}
+
+	y := new(record)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(y, &record{ID: 2, Name: "name", Dash: 3}) {
+		t.Errorf("unmarshaled: %#v", y)
+	}
+
+	type duplicate struct {
+		A int `marshal:"x"`
+		B int `marshal:"x"`
+	}
+
+	objects, err = Marshal(&duplicate{1, 2}, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if len(objects[0].(map[string]any)) != 0 {
+		t.Errorf("ambiguous fields were marshaled: %#v", objects[0])
+	}
+}
+
+func TestEmbeddedFieldNames(t *testing.T) {
+	type user struct {
+		ID   int
+		Name string
+	}
+	type group struct {
+		ID    int
+		Title string `marshal:"Name"`
+	}
+	type membership struct {
+		user
+		group
+		Role string `marshal:"Title"`
+	}
+
+	types := NewTypes()
+	if err := types.AllowUnexported(membership{}); err != nil {
+		t.Fatal(err)
+	}
+
+	x := &membership{user{1, "alice"}, group{2, "admins"}, "owner"}
+
+	objects, err := Marshal(x, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	root := objects[0].(map[string]any)
+	if _, found := root["ID"]; found {
+		t.Error("ambiguous ID field was marshaled")
+	}
+	if root["Name"] != "admins" {
+		t.Errorf("tagged name did not take precedence: %#v", root["Name"])
+	}
+	if root["Title"] != "owner" {
+		t.Errorf("shallowest field did not take precedence: %#v", root["Title"])
+	}
+
+	y := new(membership)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if *x != *y {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+
+	type a struct {
+		Key int `marshal:"ID"`
+		A   int
+	}
+	type b struct {
+		Key int `marshal:"ID"`
+		B   int
+	}
+	type shadowed struct {
+		a
+		b
+		ID int
+	}
+
+	objects, err = Marshal(&shadowed{a{1, 2}, b{3, 4}, 5}, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if expect := map[string]any{"A": 2, "B": 4, "ID": 5}; !reflect.DeepEqual(objects[0], expect) {
+		t.Errorf("shadowed: %#v", objects[0])
+	}
+
+	type ambiguous struct {
+		a
+		b
+	}
+
+	objects, err = Marshal(&ambiguous{a{1, 2}, b{3, 4}}, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	if _, found := objects[0].(map[string]any)["ID"]; found {
+		t.Errorf("ambiguous tagged field was marshaled: %#v", objects[0])
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	var head *event
+	for i := range 100 {
+		head = &event{Seq: i, Next: head}
+	}
+
+	if _, err := MarshalOptions(head, NewTypes(), Options{MaxDepth: 50}); err == nil || !strings.HasSuffix(err.Error(), ": max depth exceeded") {
+		t.Error("marshal:", err)
+	}
+
+	objects, err := MarshalOptions(head, NewTypes(), Options{MaxDepth: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UnmarshalOptions(objects, new(event), NewTypes(), Options{MaxDepth: 50}); err == nil || !strings.HasSuffix(err.Error(), ": max depth exceeded") {
+		t.Error("unmarshal:", err)
+	}
+	if err := UnmarshalOptions(objects, new(event), NewTypes(), Options{MaxDepth: 1000}); err != nil {
+		t.Error("unmarshal:", err)
+	}
+
+	type tree struct {
+		Kids []tree
+	}
+
+	nested := map[string]any{}
+	for range 100 {
+		nested = map[string]any{"Kids": []any{nested}}
+	}
+
+	if err := UnmarshalOptions([]any{nested}, new(tree), NewTypes(), Options{MaxDepth: 50}); err == nil {
+		t.Error("nested input was accepted")
+	}
+}
+
+func TestUnmarshalInvalidIndex(t *testing.T) {
+	type record struct {
+		Event *event
+		Inner *Inner
+	}
+
+	for _, c := range []struct {
+		sources []any
+		message string
+	}{
+		{[]any{map[string]any{"Event": 5}}, "at .Event: object index 5 out of range (have 1 objects)"},
+		{[]any{map[string]any{"Event": -1}}, "at .Event: negative object index: -1"},
+		{[]any{map[string]any{"Event": 1.5}, nil}, "at .Event: invalid object index: 1.5"},
+		{[]any{map[string]any{"Event": "x"}}, `at .Event: invalid object index: "x"`},
+		{[]any{map[string]any{"Event": true}}, "at .Event: expected object index for *marshal.event, got bool"},
+		{[]any{map[string]any{"Event": 0}}, "at .Event: object 0 is *marshal.record, not *marshal.event"},
+		{[]any{map[string]any{"Event": 1, "Inner": 1}, map[string]any{}}, "at .Inner: object 1 is *marshal.event, not *marshal.Inner"},
+	} {
+		err := Unmarshal(c.sources, new(record), NewTypes())
+		if err == nil || err.Error() != "unmarshal: "+c.message {
+			t.Errorf("%v: %v", c.sources, err)
+		}
+	}
+}
+
+type mutualA struct {
+	Name string
+	B    *mutualB
+}
+
+type mutualB struct {
+	Name string
+	A    *mutualA
+}
+
+func TestMutualReferences(t *testing.T) {
+	sources := []any{
+		map[string]any{"Name": "a", "B": 2},
+		map[string]any{"Name": "unused"},
+		map[string]any{"Name": "b", "A": 0},
+	}
+
+	a := new(mutualA)
+	if err := Unmarshal(sources, a, NewTypes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.B == nil || a.B.A != a {
+		t.Fatal("identity was not preserved")
+	}
+	if a.Name != "a" || a.B.Name != "b" {
+		t.Error("names:", a.Name, a.B.Name)
+	}
+}
+
+func TestRawUnknownTypes(t *testing.T) {
+	type holder struct {
+		Known   any
+		Unknown any
+		Plain   any
+	}
+
+	types := NewTypes().MustRegister(TypeName(alt1{}))
+
+	sources := []any{map[string]any{
+		"Known":   map[string]any{"alt1": map[string]any{"Alt1": "value"}},
+		"Unknown": map[string]any{"future": map[string]any{"X": 1}},
+		"Plain":   map[string]any{"a": 1, "b": 2},
+	}}
+
+	x := new(holder)
+	if err := UnmarshalOptions(sources, x, types, Options{RawUnknownTypes: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := &holder{
+		Known:   alt1{"value"},
+		Unknown: RawType{"future", map[string]any{"X": 1}},
+		Plain:   map[string]any{"a": 1, "b": 2},
+	}
+	if !reflect.DeepEqual(x, expect) {
+		t.Errorf("%#v", x)
+	}
+}
+
+func TestExplicitWrappers(t *testing.T) {
+	type holder struct {
+		Alt   alt
+		Any   any
+		Plain any
+		Raw   any
+		Alts  []alt
+	}
+
+	types := NewTypes().MustRegister(TypeName(alt1{}), Type("alt2ptr", &alt2{}))
+
+	x := &holder{
+		Alt:   alt1{"value"},
+		Any:   (*alt2)(nil),
+		Plain: map[string]any{"alt1": "not a wrapper"},
+		Alts:  []alt{&alt2{"a"}, &alt2{"b"}},
+	}
+
+	opts := Options{ExplicitWrappers: true, HomogeneousInterfaceSlices: true}
+
+	objects, err := MarshalOptions(x, types, opts)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	root := objects[0].(map[string]any)
+	if w := root["Alt"]; !reflect.DeepEqual(w, map[string]any{"$type": "alt1", "$value": map[string]any{"Alt1": "value"}}) {
+		t.Errorf("wrapper: %#v", w)
+	}
+	if w := root["Any"]; !reflect.DeepEqual(w, map[string]any{"$type": "alt2ptr", "$value": nil}) {
+		t.Errorf("typed nil wrapper: %#v", w)
+	}
+
+	y := new(holder)
+	if err := UnmarshalOptions(objects, y, types, opts); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+
+	// The one-key map is a type-name wrapper without the option.
+	z := new(holder)
+	if err := UnmarshalOptions(objects, z, types, Options{HomogeneousInterfaceSlices: true}); err == nil {
+		t.Errorf("one-key map was not mistaken for a wrapper: %#v", z.Plain)
+	}
+
+	sources := []any{map[string]any{
+		"Raw": map[string]any{"$type": "future", "$value": 1},
+	}}
+	raw := new(holder)
+	if err := UnmarshalOptions(sources, raw, types, Options{ExplicitWrappers: true, RawUnknownTypes: true}); err != nil {
+		t.Fatal(err)
+	}
+	if raw.Raw != (RawType{"future", 1}) {
+		t.Errorf("raw: %#v", raw.Raw)
+	}
+}
+
+func TestUnmarshalErrorPath(t *testing.T) {
+	type leaf struct {
+		Count int
+	}
+	type branch struct {
+		Leaves []*leaf
+		ByName map[string]leaf
+		ByID   map[int]leaf
+	}
+
+	for _, c := range []struct {
+		sources []any
+		path    string
+	}{
+		{
+			[]any{map[string]any{"Leaves": []any{1, 2}}, map[string]any{"Count": 1}, map[string]any{"Count": "x"}},
+			"unmarshal: at .Leaves[1].Count: ",
+		},
+		{
+			[]any{map[string]any{"ByName": map[string]any{"a": map[string]any{"Count": true}}}},
+			`unmarshal: at .ByName["a"].Count: `,
+		},
+		{
+			[]any{map[string]any{"ByID": map[int]any{7: "x"}}},
+			"unmarshal: at .ByID[7]: ",
+		},
+	} {
+		err := Unmarshal(c.sources, new(branch), NewTypes())
+		if err == nil || !strings.HasPrefix(err.Error(), c.path) {
+			t.Errorf("%s: %v", c.path, err)
+		}
+	}
+}
+
+func TestStructMapKeys(t *testing.T) {
+	type point struct {
+		X, Y int
+		Tag  string `marshal:"tag,omitempty"`
+	}
+
+	type grid struct {
+		Cells map[point]string
+	}
+
+	x := &grid{
+		Cells: map[point]string{
+			{1, 2, ""}:  "a",
+			{-1, 0, ""}: "b",
+			{0, 0, "o"}: "origin",
+		},
+	}
+
+	opts := Options{StructMapKeys: true}
+
+	for _, opts := range []Options{opts, {StructMapKeys: true, MapAsEntries: true}} {
+		objects, err := MarshalOptions(x, NewTypes(), opts)
+		if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+
+		if !opts.MapAsEntries {
+			cells := objects[0].(map[string]any)["Cells"].(map[string]any)
+			if cells[`{"X":1,"Y":2}`] != "a" || cells[`{"X":0,"Y":0,"tag":"o"}`] != "origin" {
+				t.Errorf("cells: %#v", cells)
+			}
+		}
+
+		y := new(grid)
+		if err := UnmarshalOptions(objects, y, NewTypes(), opts); err != nil {
+			t.Fatal("unmarshal error:", err)
+		}
+		if !reflect.DeepEqual(x, y) {
+			t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+		}
+	}
+
+	if _, err := Marshal(x, NewTypes(), false); err == nil {
+		t.Error("struct keys were marshaled without option")
+	}
+
+	type link struct {
+		From, To *point
+	}
+
+	_, err := MarshalOptions(&map[link]int{{}: 1}, NewTypes(), opts)
+	if err == nil || !strings.Contains(err.Error(), "contains pointers") {
+		t.Error("pointer key:", err)
+	}
+
+	type id struct {
+		ID int64
+	}
+
+	ids := map[id]string{{1<<53 + 1}: "a", {-(1<<53 + 1)}: "b"}
+	objects, err := MarshalOptions(&ids, NewTypes(), opts)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+	idsOut := make(map[id]string)
+	if err := UnmarshalOptions(objects, &idsOut, NewTypes(), opts); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(idsOut, ids) {
+		t.Errorf("large integer keys: %v", idsOut)
+	}
+
+	type partial struct {
+		A int
+		b int
+	}
+
+	_, err = MarshalOptions(&map[partial]int{{1, 1}: 1, {1, 2}: 2}, NewTypes(), opts)
+	if err == nil || !strings.Contains(err.Error(), "same encoding") {
+		t.Error("colliding keys:", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	type setting struct {
+		Value   int
+		Comment string `marshal:",omitempty"`
+	}
+	type config struct {
+		Settings map[string]setting
+		Order    []setting
+	}
+
+	x := &config{
+		Settings: map[string]setting{"a": {Value: 1}, "b": {Value: 2}},
+		Order:    []setting{{Value: 10}},
+	}
+
+	for _, opts := range []Options{{Merge: true}, {Merge: true, MapAsEntries: true}} {
+		objects, err := MarshalOptions(x, NewTypes(), opts)
+		if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+
+		y := &config{
+			Settings: map[string]setting{"a": {0, "first"}, "c": {3, "third"}},
+			Order:    []setting{{0, "head"}, {0, "tail"}},
+		}
+		if err := UnmarshalOptions(objects, y, NewTypes(), opts); err != nil {
+			t.Fatal("unmarshal error:", err)
+		}
+
+		expect := &config{
+			Settings: map[string]setting{"a": {1, "first"}, "b": {2, ""}, "c": {3, "third"}},
+			Order:    []setting{{10, "head"}},
+		}
+		if !reflect.DeepEqual(y, expect) {
+			t.Errorf("merged: %#v", y)
+		}
+
+		ptrs := []*int{new(int), new(int)}
+		if err := UnmarshalOptions([]any{[]any{nil, nil}}, &ptrs, NewTypes(), opts); err != nil {
+			t.Fatal("unmarshal error:", err)
+		}
+		if ptrs[0] != nil || ptrs[1] != nil {
+			t.Errorf("nil elements were not merged: %v", ptrs)
+		}
+
+		z := &config{Settings: map[string]setting{"c": {3, "third"}}}
+		if err := UnmarshalOptions(objects, z, NewTypes(), Options{}); err != nil {
+			t.Fatal("unmarshal error:", err)
+		}
+		if !reflect.DeepEqual(z, x) {
+			t.Errorf("replaced: %#v", z)
+		}
+	}
+}
+
+func TestUnmarshalAs(t *testing.T) {
+	types := NewTypes().MustRegister(TypeName(alt1{}), Type("alt2ptr", &alt2{}))
+
+	x := newTopLevel(types)
+
+	objects, err := Marshal(x, types, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := UnmarshalAs[*topLevel](objects, types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Self != p || p.Int != x.Int {
+		t.Errorf("pointer: %#v", p)
+	}
+
+	v, err := UnmarshalAs[topLevel](objects, types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Int != x.Int || v.Self == nil || v.Self.Self != v.Self {
+		t.Errorf("value: %#v", v)
+	}
+
+	n, err := UnmarshalAs[int]([]any{42}, types)
+	if err != nil || n != 42 {
+		t.Error("int:", n, err)
+	}
+
+	if _, err := UnmarshalAs[int]([]any{"x"}, types); err == nil {
+		t.Error("invalid source was accepted")
+	}
+}
+
+func TestArrayLength(t *testing.T) {
+	type holder struct {
+		Array [3]int
+	}
+
+	sources := map[string][]any{
+		"exact": {1, 2, 3},
+		"short": {1, 2},
+		"long":  {1, 2, 3, 4},
+	}
+
+	for _, c := range []struct {
+		opts   Options
+		expect map[string]any // Array or error substring.
+	}{
+		{
+			Options{},
+			map[string]any{
+				"exact": [3]int{1, 2, 3},
+				"short": "array [3]int expects 3 elements, source has 2",
+				"long":  "array [3]int expects 3 elements, source has 4",
+			},
+		},
+		{
+			Options{PadShortArrays: true},
+			map[string]any{
+				"exact": [3]int{1, 2, 3},
+				"short": [3]int{1, 2, 0},
+				"long":  "source has 4",
+			},
+		},
+		{
+			Options{TruncateLongArrays: true},
+			map[string]any{
+				"exact": [3]int{1, 2, 3},
+				"short": "source has 2",
+				"long":  [3]int{1, 2, 3},
+			},
+		},
+		{
+			Options{PadShortArrays: true, TruncateLongArrays: true},
+			map[string]any{
+				"exact": [3]int{1, 2, 3},
+				"short": [3]int{1, 2, 0},
+				"long":  [3]int{1, 2, 3},
+			},
+		},
+	} {
+		for name, src := range sources {
+			x := &holder{[3]int{7, 7, 7}}
+			err := UnmarshalOptions([]any{map[string]any{"Array": src}}, x, NewTypes(), c.opts)
+
+			switch expect := c.expect[name].(type) {
+			case [3]int:
+				if err != nil || x.Array != expect {
+					t.Errorf("%s %+v: %v %v", name, c.opts, x.Array, err)
+				}
+			case string:
+				if err == nil || !strings.Contains(err.Error(), expect) {
+					t.Errorf("%s %+v: %v", name, c.opts, err)
+				}
+			}
+		}
+	}
+}
+
+func TestNamedScalarTypes(t *testing.T) {
+	type (
+		Status string
+		Code   int
+	)
+
+	type record struct {
+		Status Status
+		Codes  map[Code]Status
+		Names  map[Status]Code
+	}
+
+	x := &record{
+		Status: "ok",
+		Codes:  map[Code]Status{200: "ok", 404: "missing"},
+		Names:  map[Status]Code{"ok": 200},
+	}
+
+	objects, err := Marshal(x, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	y := new(record)
+	if err := Unmarshal(objects, y, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, y) {
+		t.Errorf("mismatch:\nx: %#v\ny: %#v", x, y)
+	}
+
+	// Sources with unnamed types, e.g. produced by another program.
+	sources := []any{map[string]any{
+		"Status": "ok",
+		"Codes":  map[int]any{200: "ok", 404: "missing"},
+		"Names":  map[string]any{"ok": 200},
+	}}
+
+	z := new(record)
+	if err := Unmarshal(sources, z, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(x, z) {
+		t.Errorf("mismatch:\nx: %#v\nz: %#v", x, z)
+	}
+
+	data, err := MarshalJSON(x, NewTypes(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := new(record)
+	if err := UnmarshalJSON(data, j, NewTypes()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(x, j) {
+		t.Errorf("mismatch:\nx: %#v\nj: %#v", x, j)
+	}
+}
+
+func TestSyncMap(t *testing.T) {
+	type cache struct {
+		Entries sync.Map
+		Count   int
+	}
+
+	x := &cache{Count: 2}
+	x.Entries.Store("a", "alpha")
+	x.Entries.Store("b", 2)
+
+	for _, opts := range []Options{{}, {MapAsEntries: true}} {
+		objects, err := MarshalOptions(x, NewTypes(), opts)
+		if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+
+		y := new(cache)
+		y.Entries.Store("c", "stale")
+		if err := UnmarshalOptions(objects, y, NewTypes(), opts); err != nil {
+			t.Fatal("unmarshal error:", err)
+		}
+
+		entries := make(map[any]any)
+		y.Entries.Range(func(key, value any) bool {
+			entries[key] = value
+			return true
+		})
+		if expect := map[any]any{"a": "alpha", "b": 2}; !reflect.DeepEqual(entries, expect) {
+			t.Errorf("entries: %v", entries)
+		}
+		if y.Count != 2 {
+			t.Errorf("count: %d", y.Count)
+		}
+	}
+
+	x.Entries.Store(3, "three")
+	if _, err := Marshal(x, NewTypes(), false); err == nil {
+		t.Error("mixed key types were not reported")
+	}
+}
+
+func TestDisallowUnknownFields(t *testing.T) {
+	type point struct {
+		X, Y int
+	}
+
+	objects := []any{map[string]any{"X": 1, "Y": 2, "Z": 3}}
+
+	var p point
+	if err := Unmarshal(objects, &p, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if p != (point{1, 2}) {
+		t.Errorf("point: %v", p)
+	}
+
+	err := UnmarshalOptions(objects, new(point), NewTypes(), Options{DisallowUnknownFields: true})
+	if err == nil || !strings.Contains(err.Error(), `unknown field "Z"`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	objects = []any{map[string]any{"X": 1}}
+	if err := UnmarshalOptions(objects, new(point), NewTypes(), Options{DisallowUnknownFields: true}); err != nil {
+		t.Error("unmarshal error:", err)
+	}
+}
+
+func TestConcreteSourceElements(t *testing.T) {
+	type config struct {
+		Ports  []int
+		Limits map[string]uint16
+	}
+
+	objects := []any{map[string]any{
+		"Ports":  []int{80, 443},
+		"Limits": map[string]int{"conns": 100},
+	}}
+
+	var c config
+	if err := Unmarshal(objects, &c, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+
+	expect := config{Ports: []int{80, 443}, Limits: map[string]uint16{"conns": 100}}
+	if !reflect.DeepEqual(c, expect) {
+		t.Errorf("config: %#v", c)
+	}
+
+	var ports []int
+	if err := Unmarshal([]any{[]int{1, 2, 3}}, &ports, NewTypes()); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if !reflect.DeepEqual(ports, []int{1, 2, 3}) {
+		t.Errorf("ports: %v", ports)
+	}
+}
+
+func TestMaxObjects(t *testing.T) {
+	type node struct {
+		Next *node
+	}
+
+	x := &node{&node{&node{}}}
+
+	objects, err := Marshal(x, NewTypes(), false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	if err := UnmarshalOptions(objects, new(node), NewTypes(), Options{MaxObjects: len(objects)}); err != nil {
+		t.Error("unmarshal error:", err)
+	}
+
+	oversized := append(objects, make([]any, 1000)...)
+	err = UnmarshalOptions(oversized, new(node), NewTypes(), Options{MaxObjects: 100})
+	if err == nil || err.Error() != "unmarshal: 1003 objects exceed limit of 100" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMalformedSources(t *testing.T) {
+	type target struct {
+		Slice []int
+		Map   map[string]int
+		Iface alt
+		Ptr   *alt1
+	}
+
+	types := NewTypes().MustRegister(TypeName(alt1{}), TypeName(square{}))
+
+	for _, c := range []struct {
+		objects []any
+		msg     string
+	}{
+		{[]any{map[string]any{"Slice": "x"}}, "unmarshal: at .Slice: expected slice for []int, got string"},
+		{[]any{map[string]any{"Map": 1}}, "unmarshal: at .Map: expected map for map[string]int, got int"},
+		{[]any{map[string]any{"Map": map[bool]any{true: 1}}}, "unmarshal: at .Map: cannot unmarshal bool keys into map[string]int"},
+		{[]any{map[string]any{"Iface": 1}}, "unmarshal: at .Iface: expected type-name wrapper for marshal.alt, got int"},
+		{[]any{map[string]any{"Iface": map[string]any{"square": map[string]any{}}}}, `unmarshal: at .Iface: type "square" is marshal.square, which doesn't implement marshal.alt`},
+		{[]any{map[string]any{"Ptr": 1}, nil}, "unmarshal: at .Ptr: expected map for struct marshal.alt1, got invalid"},
+	} {
+		err := Unmarshal(c.objects, new(target), types)
+		if err == nil || err.Error() != c.msg {
+			t.Errorf("%v: %v", c.objects, err)
+		}
+	}
+
+	type nilObjects struct {
+		P *[]int
+		M *map[string]int
+		I *alt
+	}
+
+	x := &nilObjects{new([]int), new(map[string]int), new(alt)}
+
+	objects, err := Marshal(x, types, false)
+	if err != nil {
+		t.Fatal("marshal error:", err)
+	}
+
+	y := new(nilObjects)
+	if err := Unmarshal(objects, y, types); err != nil {
+		t.Fatal("unmarshal error:", err)
+	}
+	if y.P == nil || *y.P != nil || y.M == nil || *y.M != nil || y.I == nil || *y.I != nil {
+		t.Errorf("unmarshaled: %#v", y)
+	}
+}
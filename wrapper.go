@@ -0,0 +1,54 @@
+// Copyright (c) 2024 Timo Savola
+// SPDX-License-Identifier: BSD-3-Clause
+
+package marshal
+
+import (
+	"reflect"
+)
+
+// Keys of explicit type-name wrappers.  See Options.ExplicitWrappers.
+const (
+	wrapperTypeKey  = reservedPrefix + "type"
+	wrapperValueKey = reservedPrefix + "value"
+)
+
+// wrap a marshaled value of a registered type or codec.
+func wrap(name string, x any, explicit bool) map[string]any {
+	if explicit {
+		return map[string]any{wrapperTypeKey: name, wrapperValueKey: x}
+	}
+	return map[string]any{name: x}
+}
+
+// unwrap interprets src as a type-name wrapper without checking the name.
+// Explicit wrappers are always recognized, as type names cannot start with
+// the reserved prefix.  Single-entry maps are recognized unless explicitOnly
+// is set.
+func unwrap(src reflect.Value, explicitOnly bool) (name string, x any, ok bool) {
+	if !src.IsValid() {
+		return "", nil, false
+	}
+
+	m, ok := src.Interface().(map[string]any)
+	if !ok {
+		return "", nil, false
+	}
+
+	if name, ok := m[wrapperTypeKey].(string); ok {
+		x, found := m[wrapperValueKey]
+		if found && len(m) == 2 || !found && len(m) == 1 {
+			return name, x, true
+		}
+		return "", nil, false
+	}
+
+	if explicitOnly || len(m) != 1 {
+		return "", nil, false
+	}
+
+	for name, x := range m {
+		return name, x, true
+	}
+	panic("unreachable")
+}